@@ -7,7 +7,45 @@ psql -v ON_ERROR_STOP=1 -U "$POSTGRES_USER" --dbname "$POSTGRES_DB" <<-EOSQL
       id SERIAL PRIMARY KEY,
       login VARCHAR(255) NOT NULL,
       password VARCHAR(255) NOT NULL,
-      UNIQUE(login)
+      totp_secret VARCHAR(64) NOT NULL DEFAULT '',
+      totp_enabled boolean NOT NULL DEFAULT false,
+      totp_required boolean NOT NULL DEFAULT false,
+      totp_last_step bigint NOT NULL DEFAULT 0,
+      service_account boolean NOT NULL DEFAULT false,
+      role VARCHAR(16) NOT NULL DEFAULT 'user' CHECK (role IN ('admin', 'user', 'readonly')),
+      disabled boolean NOT NULL DEFAULT false,
+      idp_subject VARCHAR(512) NULL,
+      UNIQUE(login),
+      UNIQUE(idp_subject)
+  );
+
+  CREATE TABLE public.api_keys (
+      id SERIAL PRIMARY KEY,
+      user_id integer NOT NULL,
+      name VARCHAR(255) NOT NULL DEFAULT '',
+      prefix VARCHAR(16) NOT NULL,
+      key_hash VARCHAR(64) NOT NULL,
+      scopes text[] NOT NULL,
+      doc_prefix VARCHAR(255) NOT NULL DEFAULT '',
+      created_at timestamp NOT NULL,
+      last_used_at timestamp NOT NULL,
+      CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+      UNIQUE(key_hash)
+  );
+
+  CREATE TABLE public.recovery_codes (
+      user_id integer NOT NULL,
+      code_hash VARCHAR(64) NOT NULL,
+      CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+      UNIQUE(user_id, code_hash)
+  );
+
+  CREATE TABLE public.password_resets (
+      user_id integer NOT NULL,
+      token_hash VARCHAR(64) NOT NULL,
+      expires_at timestamp NOT NULL,
+      CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+      UNIQUE(token_hash)
   );
 
   CREATE TABLE public.docs (
@@ -17,22 +55,112 @@ psql -v ON_ERROR_STOP=1 -U "$POSTGRES_USER" --dbname "$POSTGRES_DB" <<-EOSQL
       mime VARCHAR(255) NOT NULL,
       owner_id integer NOT NULL,
       created timestamp NOT NULL,
+      status VARCHAR(16) NOT NULL DEFAULT 'clean',
+      signature VARCHAR(255) NOT NULL DEFAULT '',
+      object_key VARCHAR(255) NOT NULL,
+      json jsonb NULL,
+      version integer NOT NULL DEFAULT 1,
+      size bigint NOT NULL DEFAULT 0,
+      hash VARCHAR(64) NOT NULL DEFAULT '',
+      modified timestamp NOT NULL,
       CONSTRAINT fk_user FOREIGN KEY(owner_id) REFERENCES users(id) ON DELETE CASCADE,
-      UNIQUE(filename)
+      UNIQUE(filename),
+      UNIQUE(object_key)
+  );
+
+  CREATE TABLE public.share_links (
+      id SERIAL PRIMARY KEY,
+      doc_id integer NOT NULL,
+      slug VARCHAR(32) NOT NULL,
+      created_by integer NOT NULL,
+      password_hash VARCHAR(255) NOT NULL DEFAULT '',
+      expires_at timestamp NULL,
+      max_downloads integer NULL,
+      downloads integer NOT NULL DEFAULT 0,
+      created timestamp NOT NULL,
+      CONSTRAINT fk_doc FOREIGN KEY(doc_id) REFERENCES docs(id) ON DELETE CASCADE,
+      CONSTRAINT fk_user FOREIGN KEY(created_by) REFERENCES users(id) ON DELETE CASCADE,
+      UNIQUE(slug)
+  );
+
+  CREATE TABLE public.share_link_access (
+      link_id integer NOT NULL,
+      at timestamp NOT NULL,
+      ip VARCHAR(64) NOT NULL,
+      user_agent VARCHAR(512) NOT NULL,
+      result VARCHAR(16) NOT NULL,
+      CONSTRAINT fk_link FOREIGN KEY(link_id) REFERENCES share_links(id) ON DELETE CASCADE
+  );
+  CREATE INDEX share_link_access_link_idx ON public.share_link_access (link_id);
+
+  CREATE TABLE public.groups (
+      id SERIAL PRIMARY KEY,
+      name VARCHAR(64) NOT NULL,
+      owner_id integer NOT NULL,
+      created timestamp NOT NULL,
+      CONSTRAINT fk_user FOREIGN KEY(owner_id) REFERENCES users(id) ON DELETE CASCADE,
+      UNIQUE(name)
+  );
+
+  CREATE TABLE public.group_members (
+      group_id integer NOT NULL,
+      user_id integer NOT NULL,
+      CONSTRAINT fk_group FOREIGN KEY(group_id) REFERENCES groups(id) ON DELETE CASCADE,
+      CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+      UNIQUE(group_id, user_id)
+  );
+
+  CREATE TABLE public.docs_group_grant (
+      doc_id integer NOT NULL,
+      group_id integer NOT NULL,
+      CONSTRAINT fk_doc FOREIGN KEY(doc_id) REFERENCES docs(id) ON DELETE CASCADE,
+      permissions integer NOT NULL DEFAULT 1,
+      expires_at timestamp NULL,
+      CONSTRAINT fk_group FOREIGN KEY(group_id) REFERENCES groups(id) ON DELETE CASCADE,
+      UNIQUE(doc_id, group_id)
   );
 
   CREATE TABLE public.users_docs_grant (
       doc_id integer NOT NULL,
       user_id integer NOT NULL,
+      permissions integer NOT NULL DEFAULT 1,
+      expires_at timestamp NULL,
       CONSTRAINT fk_doc FOREIGN KEY(doc_id) REFERENCES docs(id) ON DELETE CASCADE,
       CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
       UNIQUE(doc_id, user_id)
   );
 
+  CREATE TABLE public.notifications (
+      id SERIAL PRIMARY KEY,
+      user_id integer NOT NULL,
+      message VARCHAR(1024) NOT NULL,
+      created timestamp NOT NULL,
+      CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+  );
+  CREATE INDEX notifications_user_idx ON public.notifications (user_id);
+
+  CREATE TABLE public.docs_text (
+      doc_id integer PRIMARY KEY,
+      content text NOT NULL,
+      tsv tsvector GENERATED ALWAYS AS (to_tsvector('simple', content)) STORED,
+      CONSTRAINT fk_doc FOREIGN KEY(doc_id) REFERENCES docs(id) ON DELETE CASCADE
+  );
+  CREATE INDEX docs_text_tsv_idx ON public.docs_text USING GIN (tsv);
+
   CREATE TABLE public.tokens (
+      id SERIAL PRIMARY KEY,
       user_id integer NOT NULL,
-      token VARCHAR(255) NOT NULL,
+      token_hash VARCHAR(64) NOT NULL,
+      refresh_hash VARCHAR(64) NOT NULL,
+      issued_at timestamp NOT NULL,
+      expires_at timestamp NOT NULL,
+      last_used_at timestamp NOT NULL,
+      refresh_expires_at timestamp NOT NULL,
+      device VARCHAR(255) NOT NULL DEFAULT '',
+      user_agent VARCHAR(512) NOT NULL DEFAULT '',
+      ip VARCHAR(64) NOT NULL DEFAULT '',
       CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
-      UNIQUE(token)
+      UNIQUE(token_hash),
+      UNIQUE(refresh_hash)
   );
 EOSQL
@@ -0,0 +1,168 @@
+#!/bin/bash
+
+# Upgrades a database created by the first init_db.sh to the schema of the current one.
+# Every statement can be repeated, so the script is safe to run on a partly upgraded database.
+# Files uploaded earlier are stored in minio under their filename, so it becomes their object key.
+# Plain tokens can't be turned into sessions, the tokens table is recreated and users log in again.
+
+set -e
+
+psql -v ON_ERROR_STOP=1 -U "$POSTGRES_USER" --dbname "$POSTGRES_DB" <<-EOSQL
+  BEGIN;
+
+  ALTER TABLE public.users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64) NOT NULL DEFAULT '';
+  ALTER TABLE public.users ADD COLUMN IF NOT EXISTS totp_enabled boolean NOT NULL DEFAULT false;
+  ALTER TABLE public.users ADD COLUMN IF NOT EXISTS totp_required boolean NOT NULL DEFAULT false;
+  ALTER TABLE public.users ADD COLUMN IF NOT EXISTS totp_last_step bigint NOT NULL DEFAULT 0;
+  ALTER TABLE public.users ADD COLUMN IF NOT EXISTS service_account boolean NOT NULL DEFAULT false;
+  ALTER TABLE public.users ADD COLUMN IF NOT EXISTS role VARCHAR(16) NOT NULL DEFAULT 'user'
+      CHECK (role IN ('admin', 'user', 'readonly'));
+  ALTER TABLE public.users ADD COLUMN IF NOT EXISTS disabled boolean NOT NULL DEFAULT false;
+  ALTER TABLE public.users ADD COLUMN IF NOT EXISTS idp_subject VARCHAR(512) NULL;
+  ALTER TABLE public.users DROP CONSTRAINT IF EXISTS users_idp_subject_key;
+  ALTER TABLE public.users ADD CONSTRAINT users_idp_subject_key UNIQUE(idp_subject);
+
+  CREATE TABLE IF NOT EXISTS public.api_keys (
+      id SERIAL PRIMARY KEY,
+      user_id integer NOT NULL,
+      name VARCHAR(255) NOT NULL DEFAULT '',
+      prefix VARCHAR(16) NOT NULL,
+      key_hash VARCHAR(64) NOT NULL,
+      scopes text[] NOT NULL,
+      doc_prefix VARCHAR(255) NOT NULL DEFAULT '',
+      created_at timestamp NOT NULL,
+      last_used_at timestamp NOT NULL,
+      CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+      UNIQUE(key_hash)
+  );
+
+  CREATE TABLE IF NOT EXISTS public.recovery_codes (
+      user_id integer NOT NULL,
+      code_hash VARCHAR(64) NOT NULL,
+      CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+      UNIQUE(user_id, code_hash)
+  );
+
+  CREATE TABLE IF NOT EXISTS public.password_resets (
+      user_id integer NOT NULL,
+      token_hash VARCHAR(64) NOT NULL,
+      expires_at timestamp NOT NULL,
+      CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+      UNIQUE(token_hash)
+  );
+
+  ALTER TABLE public.docs ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'clean';
+  ALTER TABLE public.docs ADD COLUMN IF NOT EXISTS signature VARCHAR(255) NOT NULL DEFAULT '';
+  ALTER TABLE public.docs ADD COLUMN IF NOT EXISTS object_key VARCHAR(255) NULL;
+  ALTER TABLE public.docs ADD COLUMN IF NOT EXISTS json jsonb NULL;
+  ALTER TABLE public.docs ADD COLUMN IF NOT EXISTS version integer NOT NULL DEFAULT 1;
+  ALTER TABLE public.docs ADD COLUMN IF NOT EXISTS size bigint NOT NULL DEFAULT 0;
+  ALTER TABLE public.docs ADD COLUMN IF NOT EXISTS hash VARCHAR(64) NOT NULL DEFAULT '';
+  ALTER TABLE public.docs ADD COLUMN IF NOT EXISTS modified timestamp NULL;
+  UPDATE public.docs SET object_key = filename WHERE object_key IS NULL;
+  UPDATE public.docs SET modified = created WHERE modified IS NULL;
+  ALTER TABLE public.docs ALTER COLUMN object_key SET NOT NULL;
+  ALTER TABLE public.docs ALTER COLUMN modified SET NOT NULL;
+  ALTER TABLE public.docs DROP CONSTRAINT IF EXISTS docs_object_key_key;
+  ALTER TABLE public.docs ADD CONSTRAINT docs_object_key_key UNIQUE(object_key);
+
+  CREATE TABLE IF NOT EXISTS public.share_links (
+      id SERIAL PRIMARY KEY,
+      doc_id integer NOT NULL,
+      slug VARCHAR(32) NOT NULL,
+      created_by integer NOT NULL,
+      password_hash VARCHAR(255) NOT NULL DEFAULT '',
+      expires_at timestamp NULL,
+      max_downloads integer NULL,
+      downloads integer NOT NULL DEFAULT 0,
+      created timestamp NOT NULL,
+      CONSTRAINT fk_doc FOREIGN KEY(doc_id) REFERENCES docs(id) ON DELETE CASCADE,
+      CONSTRAINT fk_user FOREIGN KEY(created_by) REFERENCES users(id) ON DELETE CASCADE,
+      UNIQUE(slug)
+  );
+
+  CREATE TABLE IF NOT EXISTS public.share_link_access (
+      link_id integer NOT NULL,
+      at timestamp NOT NULL,
+      ip VARCHAR(64) NOT NULL,
+      user_agent VARCHAR(512) NOT NULL,
+      result VARCHAR(16) NOT NULL,
+      CONSTRAINT fk_link FOREIGN KEY(link_id) REFERENCES share_links(id) ON DELETE CASCADE
+  );
+  CREATE INDEX IF NOT EXISTS share_link_access_link_idx ON public.share_link_access (link_id);
+
+  CREATE TABLE IF NOT EXISTS public.groups (
+      id SERIAL PRIMARY KEY,
+      name VARCHAR(64) NOT NULL,
+      owner_id integer NOT NULL,
+      created timestamp NOT NULL,
+      CONSTRAINT fk_user FOREIGN KEY(owner_id) REFERENCES users(id) ON DELETE CASCADE,
+      UNIQUE(name)
+  );
+
+  CREATE TABLE IF NOT EXISTS public.group_members (
+      group_id integer NOT NULL,
+      user_id integer NOT NULL,
+      CONSTRAINT fk_group FOREIGN KEY(group_id) REFERENCES groups(id) ON DELETE CASCADE,
+      CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+      UNIQUE(group_id, user_id)
+  );
+
+  CREATE TABLE IF NOT EXISTS public.docs_group_grant (
+      doc_id integer NOT NULL,
+      group_id integer NOT NULL,
+      CONSTRAINT fk_doc FOREIGN KEY(doc_id) REFERENCES docs(id) ON DELETE CASCADE,
+      permissions integer NOT NULL DEFAULT 1,
+      expires_at timestamp NULL,
+      CONSTRAINT fk_group FOREIGN KEY(group_id) REFERENCES groups(id) ON DELETE CASCADE,
+      UNIQUE(doc_id, group_id)
+  );
+
+  ALTER TABLE public.users_docs_grant ADD COLUMN IF NOT EXISTS permissions integer NOT NULL DEFAULT 1;
+  ALTER TABLE public.users_docs_grant ADD COLUMN IF NOT EXISTS expires_at timestamp NULL;
+
+  CREATE TABLE IF NOT EXISTS public.notifications (
+      id SERIAL PRIMARY KEY,
+      user_id integer NOT NULL,
+      message VARCHAR(1024) NOT NULL,
+      created timestamp NOT NULL,
+      CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+  );
+  CREATE INDEX IF NOT EXISTS notifications_user_idx ON public.notifications (user_id);
+
+  CREATE TABLE IF NOT EXISTS public.docs_text (
+      doc_id integer PRIMARY KEY,
+      content text NOT NULL,
+      tsv tsvector GENERATED ALWAYS AS (to_tsvector('simple', content)) STORED,
+      CONSTRAINT fk_doc FOREIGN KEY(doc_id) REFERENCES docs(id) ON DELETE CASCADE
+  );
+  CREATE INDEX IF NOT EXISTS docs_text_tsv_idx ON public.docs_text USING GIN (tsv);
+
+  DO \$\$
+  BEGIN
+      IF EXISTS (SELECT 1 FROM information_schema.columns
+                 WHERE table_schema = 'public' AND table_name = 'tokens' AND column_name = 'token') THEN
+          DROP TABLE public.tokens;
+      END IF;
+  END
+  \$\$;
+
+  CREATE TABLE IF NOT EXISTS public.tokens (
+      id SERIAL PRIMARY KEY,
+      user_id integer NOT NULL,
+      token_hash VARCHAR(64) NOT NULL,
+      refresh_hash VARCHAR(64) NOT NULL,
+      issued_at timestamp NOT NULL,
+      expires_at timestamp NOT NULL,
+      last_used_at timestamp NOT NULL,
+      refresh_expires_at timestamp NOT NULL,
+      device VARCHAR(255) NOT NULL DEFAULT '',
+      user_agent VARCHAR(512) NOT NULL DEFAULT '',
+      ip VARCHAR(64) NOT NULL DEFAULT '',
+      CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+      UNIQUE(token_hash),
+      UNIQUE(refresh_hash)
+  );
+
+  COMMIT;
+EOSQL
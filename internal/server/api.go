@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -10,28 +11,76 @@ import (
 	"github.com/go-chi/render"
 	"github.com/minio/minio-go/v7"
 	log "github.com/sirupsen/logrus"
+	"math"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Api struct {
-	rootToken string
-	db        *DB
-	fs        *FileStorage
-	cache     *Cache
+	rootToken         string
+	dummyPasswordHash string
+	loginLimiter      *AttemptLimiter
+	ipLimiter         *AttemptLimiter
+	shareLimiter      *AttemptLimiter
+	linkLimiter       *AttemptLimiter
+	legacyToken       bool
+	passwordParams    PasswordParams
+	tokenTTL          time.Duration
+	tokenIdleTimeout  time.Duration
+	refreshTTL        time.Duration
+	db                *DB
+	fs                *FileStorage
+	cache             *Cache
+	scanner           Scanner
+	thumbs            *Thumbnailer
+	extractor         *Extractor
+	jwt               *JWTVerifier
 }
 
-func Run(host string, port string, rootToken string, db *DB, fs *FileStorage, cache *Cache) error {
+// Run starts the API. jwt may be nil, then only opaque tokens and API keys are accepted.
+func Run(cfg Config, db *DB, fs *FileStorage, cache *Cache, scanner Scanner, jwt *JWTVerifier) error {
+	dummyPasswordHash, err := GeneratePasswordHash("dummy password", cfg.PasswordParams)
+	if err != nil {
+		return err
+	}
+
 	a := Api{
-		rootToken: rootToken,
-		db:        db,
-		fs:        fs,
-		cache:     cache,
+		rootToken:         cfg.RootToken,
+		legacyToken:       cfg.LegacyToken,
+		dummyPasswordHash: dummyPasswordHash,
+		loginLimiter:      NewAttemptLimiter(cfg.LoginMaxAttempts, cfg.LoginLockout),
+		ipLimiter:         NewAttemptLimiter(cfg.LoginMaxAttempts*ipAttemptsFactor, cfg.LoginLockout),
+		shareLimiter:      NewAttemptLimiter(cfg.LoginMaxAttempts, cfg.LoginLockout),
+		linkLimiter:       NewAttemptLimiter(cfg.LoginMaxAttempts*ipAttemptsFactor, cfg.LoginLockout),
+		passwordParams:    cfg.PasswordParams,
+		tokenTTL:          cfg.TokenTTL,
+		tokenIdleTimeout:  cfg.TokenIdleTimeout,
+		refreshTTL:        cfg.RefreshTTL,
+		db:                db,
+		fs:                fs,
+		cache:             cache,
+		scanner:           scanner,
+		thumbs:            NewThumbnailer(db, fs, cfg.ThumbnailWorkers),
+		extractor:         NewExtractor(db, fs, cfg.ExtractWorkers),
+		jwt:               jwt,
+	}
+	go a.runTokenPurge(cfg.TokenPurgeInterval)
+	go a.runGrantSweep(cfg.GrantSweepInterval)
+	go a.runPendingRescan(cfg.PendingRescanInterval)
+
+	if hasAdmin, err := db.HasAdmin(); err != nil {
+		return err
+	} else if !hasAdmin {
+		log.Warn("No admin exists yet, register one with the root token")
 	}
+
 	r := chi.NewRouter()
 	a.registerUrls(r)
 
-	return http.ListenAndServe(fmt.Sprintf("%s:%s", host, port), r)
+	return http.ListenAndServe(fmt.Sprintf("%s:%s", cfg.Host, cfg.Port), r)
 }
 
 func (a *Api) writeError(w http.ResponseWriter, r *http.Request, httpStatus int, msg string) {
@@ -47,30 +96,263 @@ func (a *Api) writeError(w http.ResponseWriter, r *http.Request, httpStatus int,
 }
 
 func (a *Api) registerUrls(r *chi.Mux) {
+	// share links work without an account
+	r.Get("/s/{slug}", a.shareLinkOpen)
+	r.Post("/s/{slug}", a.shareLinkOpen)
+
 	r.Route("/api", func(r chi.Router) {
 		r.Post("/register", a.register)
 
 		r.Route("/auth", func(r chi.Router) {
 			r.Post("/", a.auth)
+			r.Post("/refresh", a.authRefresh)
+			r.Post("/reset", a.passwordReset)
+			// tokens in the path end up in access logs, new clients use /current
 			r.Delete("/{token}", a.authDelete)
+
+			// users who must enroll into 2FA can reach only these routes
+			r.Group(func(r chi.Router) {
+				r.Use(a.authenticateEnrollment, a.sessionOnly)
+				r.Delete("/", a.authDeleteAll)
+				r.Delete("/current", a.authLogout)
+				r.Post("/2fa/enroll", a.totpEnroll)
+				r.Post("/2fa/confirm", a.totpConfirm)
+			})
+
+			r.Group(func(r chi.Router) {
+				r.Use(a.authenticate, a.sessionOnly)
+				r.Delete("/2fa", a.totpDisable)
+				r.Post("/password", a.passwordChange)
+				r.Get("/sessions", a.sessionsList)
+				r.Delete("/sessions", a.sessionsDeleteOthers)
+				r.Delete("/sessions/{id}", a.sessionsDelete)
+			})
 		})
 
 		r.Route("/docs", func(r chi.Router) {
-			r.Post("/", a.docsPost)
-			r.Get("/", a.docsGetAll)
-			r.Head("/", a.docsHeadAll)
-			r.Get("/{id}", a.docsGetOne)
-			r.Head("/{id}", a.docsHeadOne)
-			r.Delete("/{id}", a.docsDelete)
+			r.With(a.legacyMetaToken, a.authenticate, a.requireScope(ScopeDocsWrite)).Post("/", a.docsPost)
+
+			r.Group(func(r chi.Router) {
+				r.Use(a.authenticate, a.requireScope(ScopeDocsRead))
+				r.Get("/", a.docsGetAll)
+				r.Head("/", a.docsHeadAll)
+				r.Post("/zip", a.docsZip)
+				r.Get("/{id}", a.docsGetOne)
+				r.Head("/{id}", a.docsHeadOne)
+				r.Get("/{id}/thumbnail", a.docsThumbnail)
+				r.Get("/{id}/grants", a.docGrantsGet)
+			})
+
+			r.Group(func(r chi.Router) {
+				r.Use(a.authenticate, a.requireScope(ScopeDocsWrite))
+				r.Patch("/{id}", a.docsPatch)
+				r.Put("/{id}", a.docsPut)
+				r.Patch("/{id}/grants", a.docGrantsPatch)
+				r.Put("/{id}/grants", a.docGrantsPut)
+				r.Get("/{id}/links", a.shareLinksList)
+				r.Post("/{id}/links", a.shareLinksCreate)
+				r.Delete("/{id}/links/{linkId}", a.shareLinksDelete)
+				r.Get("/{id}/links/{linkId}/log", a.shareLinkLog)
+			})
+
+			r.With(a.authenticate, a.requireScope(ScopeDocsWrite)).Post("/import", a.docsImport)
+			r.With(a.authenticate, a.requireScope(ScopeDocsDelete)).Delete("/{id}", a.docsDelete)
+		})
+
+		r.Route("/groups", func(r chi.Router) {
+			r.Use(a.authenticate)
+			r.With(a.requireScope(ScopeDocsRead)).Get("/", a.groupsList)
+
+			r.Group(func(r chi.Router) {
+				r.Use(a.requireScope(ScopeDocsWrite))
+				r.Post("/", a.groupsCreate)
+				r.Delete("/{name}", a.groupsDelete)
+				r.Post("/{name}/members", a.groupMembersAdd)
+				r.Delete("/{name}/members/{login}", a.groupMembersDelete)
+			})
+		})
+
+		r.Route("/notifications", func(r chi.Router) {
+			r.Use(a.authenticate)
+			r.Get("/", a.notificationsList)
+			r.Delete("/{id}", a.notificationsDelete)
+		})
+
+		r.Route("/keys", func(r chi.Router) {
+			r.Use(a.authenticate, a.sessionOnly)
+			r.Post("/", a.apiKeysCreate)
+			r.Get("/", a.apiKeysList)
+			r.Delete("/{id}", a.apiKeysDelete)
+		})
+
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(a.authenticate, a.requireScope(ScopeAdmin))
+			r.Get("/quarantine", a.quarantineList)
+			r.Post("/quarantine/{id}/release", a.quarantineRelease)
+			r.Delete("/quarantine/{id}", a.quarantinePurge)
+			r.Post("/users/{login}/unlock", a.userUnlock)
+			r.Post("/users/{login}/reset", a.passwordResetCreate)
+			r.Post("/service-accounts", a.serviceAccountCreate)
+			r.Group(func(r chi.Router) {
+				r.Use(a.sessionOnly)
+				r.Post("/users/{login}/keys", a.userAPIKeysCreate)
+				r.Get("/users/{login}/keys", a.userAPIKeysList)
+				r.Delete("/users/{login}/keys/{id}", a.userAPIKeysDelete)
+			})
+			r.Get("/users", a.usersList)
+			r.Delete("/users/{login}", a.userDelete)
+			r.Post("/users/{login}/disable", a.userDisable)
+			r.Post("/users/{login}/enable", a.userEnable)
+			r.Put("/users/{login}/role", a.userRole)
+			r.Put("/users/{login}/idp", a.userIdpLink)
+			r.Delete("/users/{login}/idp", a.userIdpUnlink)
+			r.Put("/users/{login}/2fa", a.totpRequire)
+			r.Delete("/users/{login}/2fa", a.totpReset)
 		})
 	})
 }
 
 func (a *Api) identity(requestToken string) (*UserToken, error) {
-	if token, ok := a.cache.GetUserToken(requestToken); token.Token == requestToken && ok {
-		return &token, nil
+	var usertoken *UserToken
+	var err error
+	switch {
+	case strings.HasPrefix(requestToken, apiKeyPrefix):
+		usertoken, err = a.apiKeyIdentity(requestToken)
+	case a.jwt != nil && LooksLikeJWT(requestToken):
+		usertoken, err = a.jwtIdentity(requestToken)
+	default:
+		usertoken, err = a.sessionIdentity(requestToken)
+	}
+	if err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("Token %s doesn't exist. ", requestToken)
+
+	usertoken.GroupIds = a.cache.GetUserGroups(usertoken.UserID)
+	return usertoken, nil
+}
+
+func (a *Api) sessionIdentity(requestToken string) (*UserToken, error) {
+	tokenHash := HashToken(requestToken)
+	token, ok := a.cache.GetUserToken(tokenHash)
+	if token.TokenHash != tokenHash || !ok {
+		return nil, fmt.Errorf("Token doesn't exist. ")
+	}
+
+	now := time.Now().UTC()
+	if !now.Before(token.ExpiresAt) || now.Sub(token.LastUsedAt) >= a.tokenIdleTimeout {
+		return nil, fmt.Errorf("Token expired. ")
+	}
+	if token.Disabled {
+		return nil, fmt.Errorf("User is disabled. ")
+	}
+
+	// last usage is written to db at most once per tokenTouchInterval
+	if now.Sub(token.LastUsedAt) >= tokenTouchInterval {
+		a.cache.TouchUserToken(tokenHash, now)
+		go func() {
+			if err := a.db.TouchToken(tokenHash, now); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+	return &token, nil
+}
+
+// jwtIdentity maps a verified JWT of the identity provider to the local user bound to its subject,
+// creating one if provisioning is on. A JWT never reaches a local account by its login alone,
+// an admin has to link the subject explicitly. 2FA is up to the provider, so users with local 2FA are rejected.
+func (a *Api) jwtIdentity(requestToken string) (*UserToken, error) {
+	claims, err := a.jwt.Verify(requestToken)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := a.db.GetUserBySubject(claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		if !a.jwt.cfg.Provision {
+			return nil, fmt.Errorf("No user is linked to jwt subject %s. ", claims.Subject)
+		}
+		if !IsLoginValid(claims.Login) {
+			return nil, fmt.Errorf("Jwt login %q can't be provisioned. %s ", claims.Login, loginRequirementsMsg)
+		}
+		if local, err := a.db.GetUser(claims.Login); err != nil {
+			return nil, err
+		} else if local != nil {
+			return nil, fmt.Errorf("Login %s belongs to a local user, an admin has to link the jwt subject to it. ", claims.Login)
+		}
+		// concurrent first requests may race, the loser just reads the created user
+		if err := a.db.CreateIdpUser(claims.Login, claims.Subject); err != nil {
+			log.Warn(err)
+		} else {
+			log.Infof("Provisioned user %s from jwt subject %s", claims.Login, claims.Subject)
+		}
+		if user, err = a.db.GetUserBySubject(claims.Subject); err != nil || user == nil {
+			return nil, fmt.Errorf("Failed to provision user %s. ", claims.Login)
+		}
+	}
+	if user.ServiceAccount {
+		return nil, fmt.Errorf("Service accounts can't use jwt. ")
+	}
+	if user.Disabled {
+		return nil, fmt.Errorf("User is disabled. ")
+	}
+	if user.TotpEnabled || user.TotpRequired {
+		return nil, fmt.Errorf("User has 2FA, log in with password and code. ")
+	}
+
+	return &UserToken{
+		UserID:     user.Id,
+		Login:      user.Login,
+		TokenHash:  HashToken(requestToken),
+		IssuedAt:   claims.IssuedAt,
+		ExpiresAt:  claims.ExpiresAt,
+		LastUsedAt: time.Now().UTC(),
+		Role:       user.Role,
+	}, nil
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (a *Api) isRoot(requestToken string) bool {
+	return subtle.ConstantTimeCompare([]byte(requestToken), []byte(a.rootToken)) == 1
+}
+
+func (a *Api) scanDoc(docId int64, data []byte) string {
+	result, err := a.scanner.Scan(context.Background(), bytes.NewReader(data))
+	if err != nil {
+		log.Errorf("Failed to scan doc %d. Error: %s", docId, err)
+		return DocStatusPending
+	}
+
+	status := DocStatusClean
+	if !result.Clean {
+		status = DocStatusInfected
+		log.Warnf("Doc %d quarantined, signature: %s", docId, result.Signature)
+	}
+
+	if err := a.db.SetDocStatus(docId, status, result.Signature); err != nil {
+		log.Error(err)
+		return DocStatusPending
+	}
+	return status
+}
+
+func (a *Api) allowAttempt(w http.ResponseWriter, r *http.Request, limiter *AttemptLimiter, key string) bool {
+	ok, wait := limiter.Allow(key)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		a.writeError(w, r, http.StatusTooManyRequests, "Too many failed attempts, try again later")
+	}
+	return ok
 }
 
 func (a *Api) register(w http.ResponseWriter, r *http.Request) {
@@ -81,24 +363,70 @@ func (a *Api) register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if input.Token != a.rootToken {
-		a.writeError(w, r, http.StatusBadRequest, "Incorrect root token")
+	// admins register users with their own credentials, the root token only bootstraps the first admin
+	var bootstrap bool
+	if requestToken := a.requestToken(r); requestToken != "" {
+		caller, err := a.identity(requestToken)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			a.writeError(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if !caller.HasScope(ScopeAdmin) {
+			a.writeError(w, r, http.StatusForbidden, "Only admins can register users")
+			return
+		}
+	} else {
+		ip := clientIP(r)
+		if !a.allowAttempt(w, r, a.ipLimiter, ip) {
+			return
+		}
+		if !a.isRoot(input.Token) {
+			a.ipLimiter.Fail(ip)
+			a.writeError(w, r, http.StatusBadRequest, "Incorrect root token")
+			return
+		}
+		bootstrap = true
+	}
+
+	if !IsLoginValid(input.Login) {
+		a.writeError(w, r, http.StatusBadRequest, loginRequirementsMsg)
+		return
+	}
+
+	role := input.Role
+	if role == "" {
+		role = RoleUser
+	}
+	if !IsRole(role) {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Role must be one of %v", Roles))
 		return
 	}
 
 	if validPassword := IsPasswordValid(input.Password); !validPassword {
-		a.writeError(w, r, http.StatusBadRequest, "Password must contain: minimum length 8, digits, at least 2 letters in different cases, at least 1 character (not a letter or a number)")
+		a.writeError(w, r, http.StatusBadRequest, passwordRequirementsMsg)
 		return
 	}
 
-	passwordHash, err := GeneratePasswordHash(input.Password)
+	passwordHash, err := GeneratePasswordHash(input.Password, a.passwordParams)
 	if err != nil {
 		a.writeError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	err = a.db.CreateNewUser(input.Login, passwordHash)
-	if err != nil {
+	if bootstrap {
+		role = RoleAdmin
+		created, err := a.db.CreateFirstAdmin(input.Login, passwordHash)
+		if err != nil {
+			a.writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !created {
+			a.writeError(w, r, http.StatusForbidden, "Admin already exists, root token is no longer accepted")
+			return
+		}
+		log.Infof("Bootstrapped admin %s with the root token", input.Login)
+	} else if err := a.db.CreateNewUser(input.Login, passwordHash, role); err != nil {
 		a.writeError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -106,6 +434,7 @@ func (a *Api) register(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, Response{
 		Response: render.M{
 			"login": input.Login,
+			"role":  role,
 		},
 	})
 }
@@ -118,9 +447,10 @@ func (a *Api) auth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	passwordHash, err := GeneratePasswordHash(input.Password)
-	if err != nil {
-		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+	// the login is limited together with the IP, otherwise anyone could lock any account out
+	ip := clientIP(r)
+	loginKey := input.Login + "|" + ip
+	if !a.allowAttempt(w, r, a.loginLimiter, loginKey) || !a.allowAttempt(w, r, a.ipLimiter, ip) {
 		return
 	}
 
@@ -130,38 +460,134 @@ func (a *Api) auth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user == nil {
-		a.writeError(w, r, http.StatusNotFound, fmt.Sprintf("User %s not found", input.Login))
-		return
+	// unknown users are checked against a dummy hash, so both cases take the same time and look the same
+	passwordHash := a.dummyPasswordHash
+	if user != nil {
+		passwordHash = user.Password
 	}
 
-	if user.Password != passwordHash {
-		a.writeError(w, r, http.StatusForbidden, fmt.Sprintf("Invalid password"))
+	valid, rehash, err := VerifyPassword(input.Password, passwordHash, a.passwordParams)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if user == nil || user.ServiceAccount || !valid {
+		a.loginLimiter.Fail(loginKey)
+		a.ipLimiter.Fail(ip)
+		a.writeError(w, r, http.StatusForbidden, "Invalid login or password")
+		return
+	}
+	if user.Disabled {
+		a.writeError(w, r, http.StatusForbidden, "User is disabled")
 		return
 	}
 
-	userToken, ok := a.cache.GetUserTokenByUserID(user.Id)
-	tokenStr := userToken.Token
-	if !ok {
-		token, err := a.db.CreateToken(user.Id)
+	if user.TotpEnabled {
+		if input.OTP == "" && input.RecoveryCode == "" {
+			// counted as a failure, otherwise the answer would confirm the password for free
+			a.loginLimiter.Fail(loginKey)
+			a.ipLimiter.Fail(ip)
+			a.writeError(w, r, http.StatusUnauthorized, "Two-factor code required")
+			return
+		}
+		ok, err := a.checkSecondFactor(user, TOTPRequest{OTP: input.OTP, RecoveryCode: input.RecoveryCode})
 		if err != nil {
 			a.writeError(w, r, http.StatusInternalServerError, err.Error())
 			return
 		}
-		tokenStr = token.Token
-		a.cache.Ch <- SyncTokens
+		if !ok {
+			a.loginLimiter.Fail(loginKey)
+			a.ipLimiter.Fail(ip)
+			a.writeError(w, r, http.StatusForbidden, "Invalid two-factor code")
+			return
+		}
+	}
+	a.loginLimiter.Reset(loginKey)
+
+	// upgrade legacy or outdated hashes while we know the plain password
+	if rehash {
+		if passwordHash, err := GeneratePasswordHash(input.Password, a.passwordParams); err != nil {
+			log.Error(err)
+		} else if err := a.db.UpdateUserPassword(user.Id, passwordHash); err != nil {
+			log.Error(err)
+		}
+	}
+
+	// only token hashes are stored, so every login gets a new token
+	token, err := a.db.CreateToken(user.Id, SessionInfo{
+		Device:    input.Device,
+		UserAgent: r.UserAgent(),
+		IP:        ip,
+	}, a.tokenTTL, a.refreshTTL)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
 	}
+	a.cache.Ch <- SyncTokens
 
 	render.JSON(w, r, Response{
-		Response: render.M{
-			"token": tokenStr,
-		},
+		Response: issuedTokenResponse(token),
+	})
+}
+
+func issuedTokenResponse(token *IssuedToken) render.M {
+	return render.M{
+		"token":              token.Token,
+		"expires_at":         token.ExpiresAt.Format(time.RFC3339),
+		"refresh_token":      token.RefreshToken,
+		"refresh_expires_at": token.RefreshExpiresAt.Format(time.RFC3339),
+	}
+}
+
+func (a *Api) authRefresh(w http.ResponseWriter, r *http.Request) {
+	var input RefreshRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to decode json body. Error: %s ", err))
+		return
+	}
+
+	token, err := a.db.RefreshToken(HashToken(input.RefreshToken), a.tokenTTL, a.refreshTTL, a.tokenIdleTimeout)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if token == nil {
+		a.writeError(w, r, http.StatusForbidden, "Refresh token is invalid or expired")
+		return
+	}
+	a.cache.Ch <- SyncTokens
+
+	render.JSON(w, r, Response{
+		Response: issuedTokenResponse(token),
 	})
 }
 
 func (a *Api) authDelete(w http.ResponseWriter, r *http.Request) {
+	caller, err := a.identity(a.requestToken(r))
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		a.writeError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if caller.APIKeyID != 0 {
+		a.writeError(w, r, http.StatusForbidden, "API keys can't manage sessions")
+		return
+	}
+
 	token := chi.URLParam(r, "token")
-	err := a.db.DeleteToken(token)
+	target, err := a.db.GetTokenByHash(HashToken(token))
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// tokens of other users look missing, so the answer doesn't tell whether a token is valid
+	if target == nil || (caller.UserID != target.UserId && caller.Role != RoleAdmin) {
+		a.writeError(w, r, http.StatusNotFound, "Token doesn't exist")
+		return
+	}
+
+	err = a.db.DeleteToken(target.TokenHash)
 	if err != nil {
 		a.writeError(w, r, http.StatusInternalServerError, err.Error())
 		return
@@ -175,6 +601,43 @@ func (a *Api) authDelete(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (a *Api) authLogout(w http.ResponseWriter, r *http.Request) {
+	usertoken := userToken(r)
+	if usertoken.SessionID == 0 {
+		a.writeError(w, r, http.StatusBadRequest, "Only a session can log out, JWTs expire on their own")
+		return
+	}
+
+	if err := a.db.DeleteToken(usertoken.TokenHash); err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.cache.Ch <- SyncTokens
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"current": true,
+		},
+	})
+}
+
+func (a *Api) authDeleteAll(w http.ResponseWriter, r *http.Request) {
+	usertoken := userToken(r)
+
+	n, err := a.db.DeleteUserTokens(usertoken.UserID)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.cache.Ch <- SyncTokens
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"revoked": n,
+		},
+	})
+}
+
 func (a *Api) docsPost(w http.ResponseWriter, r *http.Request) {
 	var input DocPostRequest
 
@@ -183,9 +646,9 @@ func (a *Api) docsPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	usertoken, err := a.identity(input.Meta.Token)
-	if err != nil {
-		a.writeError(w, r, http.StatusForbidden, err.Error())
+	usertoken := userToken(r)
+	if !usertoken.InDocPrefix(input.Meta.Name) {
+		a.writeError(w, r, http.StatusForbidden, "File name is outside of the API key prefix")
 		return
 	}
 
@@ -197,30 +660,33 @@ func (a *Api) docsPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !a.checkGrantees(w, r, input.Meta.Grant) {
+		return
+	}
+
 	filedata, err := base64.StdEncoding.DecodeString(input.File.Data)
 	if err != nil {
 		a.writeError(w, r, http.StatusInternalServerError, "Failed to decode string from base64")
 		return
 	}
 
-	// minio save file
-	_, err = a.fs.client.PutObject(
-		context.Background(),
-		MinioBucketName,
-		input.Meta.Name,
-		bytes.NewReader(filedata),
-		int64(len(filedata)),
-		minio.PutObjectOptions{},
-	)
-	if err != nil {
-		a.writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Failed to put object to minio. Error: %s ", err))
-		return
+	var docJson *string
+	if len(input.Json) > 0 && string(input.Json) != "null" {
+		s := string(input.Json)
+		docJson = &s
 	}
 
-	// db save file
-	err = a.db.CreateDoc(input.Meta.Name, input.Meta.Public, input.Meta.Mime, usertoken.UserID, input.Meta.Grant)
+	docId, status, err := a.storeDoc(NewDoc{
+		Filename: input.Meta.Name,
+		Public:   input.Meta.Public,
+		Mime:     input.Meta.Mime,
+		OwnerId:  usertoken.UserID,
+		Grant:    input.Meta.Grant,
+		Json:     docJson,
+	}, filedata)
 	if err != nil {
 		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
 	}
 
 	// invalidate cache
@@ -228,23 +694,61 @@ func (a *Api) docsPost(w http.ResponseWriter, r *http.Request) {
 
 	render.JSON(w, r, render.M{
 		"data": render.M{
-			"json": render.M{},
-			"file": input.Meta.Name,
+			"json":   jsonOrEmpty(docJson),
+			"file":   input.Meta.Name,
+			"id":     docId,
+			"status": status,
 		},
 	})
 
 }
 
-func (a *Api) docsGetAll(w http.ResponseWriter, r *http.Request) {
-	token := r.URL.Query().Get("token")
-	_, err := a.identity(token)
+// storeDoc saves the file to minio and the doc to db, then scans it.
+// The doc stays in quarantine until the scan passes. Cache is not synced here.
+func (a *Api) storeDoc(doc NewDoc, data []byte) (int64, string, error) {
+	// the key is random, so renaming the doc never touches minio
+	objectKey, err := GenerateSecureToken()
 	if err != nil {
-		a.writeError(w, r, http.StatusForbidden, err.Error())
-		return
+		return 0, "", err
+	}
+	doc.ObjectKey = objectKey
+	doc.Size = int64(len(data))
+	doc.Hash = ContentHash(data)
+
+	// minio save file
+	err = a.fs.Put(context.Background(), MinioBucketName, doc.ObjectKey, data, doc.Mime)
+	if err != nil {
+		return 0, "", err
+	}
+
+	// db save file
+	doc.Status = DocStatusPending
+	docId, err := a.db.CreateDoc(doc)
+	if err != nil {
+		if rmErr := a.fs.client.RemoveObject(context.Background(), MinioBucketName, doc.ObjectKey, minio.RemoveObjectOptions{}); rmErr != nil {
+			log.Error(rmErr)
+		}
+		return 0, "", err
 	}
 
+	status := a.scanDoc(docId, data)
+	if status == DocStatusClean {
+		a.enqueueProcessing(Doc{Id: docId, Filename: doc.Filename, Mime: doc.Mime, ObjectKey: doc.ObjectKey})
+	}
+	return docId, status, nil
+}
+
+func (a *Api) enqueueProcessing(doc Doc) {
+	a.thumbs.Enqueue(doc)
+	a.extractor.Enqueue(doc)
+}
+
+func (a *Api) docsGetAll(w http.ResponseWriter, r *http.Request) {
+	usertoken := userToken(r)
+
 	limitParam := r.URL.Query().Get("limit")
 	var limit int
+	var err error
 	if limitParam != "" {
 		limit, err = strconv.Atoi(limitParam)
 		if err != nil {
@@ -254,33 +758,28 @@ func (a *Api) docsGetAll(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// TODO Filters
-	cacheDocs := a.cache.getDocs()
-
-	users := make(map[int64]string)
-	for _, ut := range a.cache.GetUserTokens() {
-		users[ut.UserID] = ut.Login
+	var cacheDocs []Doc
+	if query := r.URL.Query().Get("q"); query != "" {
+		ids, err := a.db.SearchDocs(query)
+		if err != nil {
+			a.writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		cacheDocs = a.cache.getDocsByIDs(ids)
+	} else {
+		for _, doc := range a.cache.getDocs() {
+			cacheDocs = append(cacheDocs, doc)
+		}
 	}
 
 	docs := make([]DocResponse, 0, len(cacheDocs))
 
 	for _, doc := range cacheDocs {
-		docResp := DocResponse{
-			Id:      doc.Id,
-			Name:    doc.Filename,
-			Mime:    doc.Mime,
-			File:    true,
-			Public:  doc.Public,
-			Created: doc.Created.Format("2006-01-02 15:04:05"),
-			Grant:   nil,
-		}
-
-		grant := make([]string, 0, len(doc.GrantIds))
-		for _, gid := range doc.GrantIds {
-			grant = append(grant, users[gid])
+		if doc.Status != DocStatusClean || !canRead(usertoken, doc) {
+			continue
 		}
 
-		docResp.Grant = grant
-		docs = append(docs, docResp)
+		docs = append(docs, NewDocResponse(doc))
 		if limit > 0 && len(docs) >= limit {
 			break
 		}
@@ -295,16 +794,9 @@ func (a *Api) docsGetAll(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *Api) docsHeadAll(w http.ResponseWriter, r *http.Request) {
-	token := r.URL.Query().Get("token")
-	_, err := a.identity(token)
-	if err != nil {
-		a.writeError(w, r, http.StatusForbidden, err.Error())
-		return
-	}
-
 	limitParam := r.URL.Query().Get("limit")
 	if limitParam != "" {
-		_, err = strconv.Atoi(limitParam)
+		_, err := strconv.Atoi(limitParam)
 		if err != nil {
 			a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Limit parameter must be integer. Error: %s", err))
 			return
@@ -313,13 +805,6 @@ func (a *Api) docsHeadAll(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *Api) docsGetOne(w http.ResponseWriter, r *http.Request) {
-	token := r.URL.Query().Get("token")
-	_, err := a.identity(token)
-	if err != nil {
-		a.writeError(w, r, http.StatusForbidden, err.Error())
-		return
-	}
-
 	docIdParam := chi.URLParam(r, "id")
 	docId, err := strconv.Atoi(docIdParam)
 	if err != nil {
@@ -328,12 +813,12 @@ func (a *Api) docsGetOne(w http.ResponseWriter, r *http.Request) {
 	}
 
 	doc, ok := a.cache.getDocByID(int64(docId))
-	if !ok {
+	if !ok || doc.Status != DocStatusClean || !canRead(userToken(r), doc) {
 		a.writeError(w, r, http.StatusNotFound, "File doesn't exist")
 		return
 	}
 
-	object, err := a.fs.client.GetObject(context.Background(), MinioBucketName, doc.Filename, minio.GetObjectOptions{})
+	object, err := a.fs.client.GetObject(context.Background(), MinioBucketName, doc.ObjectKey, minio.GetObjectOptions{})
 	if err != nil {
 		a.writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Failed to get file from minio. Error: %s ", err))
 		return
@@ -346,23 +831,40 @@ func (a *Api) docsGetOne(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	docJson, err := a.db.GetDocJson(doc.Id)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("ETag", docETag(doc))
 	render.JSON(w, r, render.M{
 		"data": render.M{
 			"name": doc.Filename,
 			"mime": doc.Mime,
+			"json": jsonOrEmpty(docJson),
 			"file": base64.StdEncoding.EncodeToString(buf.Bytes()),
 		},
 	})
 }
 
 func (a *Api) docsHeadOne(w http.ResponseWriter, r *http.Request) {
-	token := r.URL.Query().Get("token")
-	_, err := a.identity(token)
+	docIdParam := chi.URLParam(r, "id")
+	docId, err := strconv.Atoi(docIdParam)
 	if err != nil {
-		a.writeError(w, r, http.StatusForbidden, err.Error())
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Doc id parameter must be integer. Error: %s", err))
+		return
+	}
+
+	doc, ok := a.cache.getDocByID(int64(docId))
+	if !ok || doc.Status != DocStatusClean || !canRead(userToken(r), doc) {
+		a.writeError(w, r, http.StatusNotFound, "File doesn't exist")
 		return
 	}
+	w.Header().Set("ETag", docETag(doc))
+}
 
+func (a *Api) docsThumbnail(w http.ResponseWriter, r *http.Request) {
 	docIdParam := chi.URLParam(r, "id")
 	docId, err := strconv.Atoi(docIdParam)
 	if err != nil {
@@ -370,21 +872,51 @@ func (a *Api) docsHeadOne(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, ok := a.cache.getDocByID(int64(docId))
-	if !ok {
+	size := DefaultThumbnailSize
+	if sizeParam := r.URL.Query().Get("size"); sizeParam != "" {
+		size, err = strconv.Atoi(sizeParam)
+		if err != nil || !IsThumbnailSize(size) {
+			a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Size parameter must be one of %v", ThumbnailSizes))
+			return
+		}
+	}
+
+	doc, ok := a.cache.getDocByID(int64(docId))
+	if !ok || doc.Status != DocStatusClean || !canRead(userToken(r), doc) {
 		a.writeError(w, r, http.StatusNotFound, "File doesn't exist")
 		return
 	}
-}
 
-func (a *Api) docsDelete(w http.ResponseWriter, r *http.Request) {
-	token := r.URL.Query().Get("token")
-	_, err := a.identity(token)
+	if !IsImageMime(doc.Mime) {
+		a.writeError(w, r, http.StatusNotFound, "File has no thumbnail")
+		return
+	}
+
+	object, err := a.fs.client.GetObject(context.Background(), MinioThumbnailsBucketName, ThumbnailKey(doc.Id, doc.ObjectKey, size), minio.GetObjectOptions{})
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Failed to get thumbnail from minio. Error: %s ", err))
+		return
+	}
+	defer object.Close()
+
+	info, err := object.Stat()
 	if err != nil {
-		a.writeError(w, r, http.StatusForbidden, err.Error())
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			a.writeError(w, r, http.StatusNotFound, "Thumbnail is not ready yet")
+			return
+		}
+		a.writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Failed to get thumbnail from minio. Error: %s ", err))
 		return
 	}
 
+	// the url stays the same when the content is replaced, so clients revalidate by the doc version every time
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("ETag", fmt.Sprintf(`"v%d-%d"`, doc.Version, size))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeContent(w, r, "", info.LastModified, object)
+}
+
+func (a *Api) docsDelete(w http.ResponseWriter, r *http.Request) {
 	docIdParam := chi.URLParam(r, "id")
 	docId, err := strconv.Atoi(docIdParam)
 	if err != nil {
@@ -392,12 +924,31 @@ func (a *Api) docsDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	usertoken := userToken(r)
+	doc, ok := a.cache.getDocByID(int64(docId))
+	admin := usertoken.HasScope(ScopeAdmin) && usertoken.InDocPrefix(doc.Filename)
+	if !ok || !(admin || canRead(usertoken, doc)) {
+		a.writeError(w, r, http.StatusNotFound, "File doesn't exist")
+		return
+	}
+	if !(admin || can(usertoken, doc, PermDelete)) {
+		a.writeError(w, r, http.StatusForbidden, "No delete permission for the file")
+		return
+	}
+
 	err = a.db.DeleteDoc(int64(docId))
 	if err != nil {
 		a.writeError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	if err := a.fs.client.RemoveObject(context.Background(), MinioBucketName, doc.ObjectKey, minio.RemoveObjectOptions{}); err != nil {
+		log.Error(err)
+	}
+	if err := a.fs.RemoveThumbnails(context.Background(), int64(docId)); err != nil {
+		log.Error(err)
+	}
+
 	a.cache.Ch <- SyncDocs
 
 	render.JSON(w, r, render.M{
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/minio/minio-go/v7"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func (a *Api) urlUser(w http.ResponseWriter, r *http.Request) *User {
+	login := chi.URLParam(r, "login")
+	user, err := a.db.GetUser(login)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return nil
+	}
+	if user == nil {
+		a.writeError(w, r, http.StatusNotFound, fmt.Sprintf("User %s not found", login))
+		return nil
+	}
+	return user
+}
+
+func (a *Api) quarantinedDoc(w http.ResponseWriter, r *http.Request) (*Doc, bool) {
+	docIdParam := chi.URLParam(r, "id")
+	docId, err := strconv.Atoi(docIdParam)
+	if err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Doc id parameter must be integer. Error: %s", err))
+		return nil, false
+	}
+
+	doc, ok := a.cache.getDocByID(int64(docId))
+	if !ok || doc.Status == DocStatusClean {
+		a.writeError(w, r, http.StatusNotFound, "Quarantined file doesn't exist")
+		return nil, false
+	}
+	return &doc, true
+}
+
+func (a *Api) quarantineList(w http.ResponseWriter, r *http.Request) {
+	docs := make([]render.M, 0)
+	for _, doc := range a.cache.getDocs() {
+		if doc.Status == DocStatusClean {
+			continue
+		}
+		docs = append(docs, render.M{
+			"id":        doc.Id,
+			"name":      doc.Filename,
+			"mime":      doc.Mime,
+			"owner_id":  doc.OwnerId,
+			"created":   doc.Created.Format("2006-01-02 15:04:05"),
+			"status":    doc.Status,
+			"signature": doc.Signature,
+		})
+	}
+
+	render.JSON(w, r, render.M{
+		"data": render.M{
+			"docs": docs,
+		},
+	})
+}
+
+func (a *Api) quarantineRelease(w http.ResponseWriter, r *http.Request) {
+	doc, ok := a.quarantinedDoc(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.db.SetDocStatus(doc.Id, DocStatusClean, ""); err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.enqueueProcessing(*doc)
+
+	a.cache.Ch <- SyncDocs
+
+	render.JSON(w, r, Response{
+		Response: render.M{
+			strconv.FormatInt(doc.Id, 10): true,
+		},
+	})
+}
+
+func (a *Api) quarantinePurge(w http.ResponseWriter, r *http.Request) {
+	doc, ok := a.quarantinedDoc(w, r)
+	if !ok {
+		return
+	}
+
+	err := a.fs.client.RemoveObject(context.Background(), MinioBucketName, doc.ObjectKey, minio.RemoveObjectOptions{})
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Failed to remove object from minio. Error: %s ", err))
+		return
+	}
+
+	if err := a.db.DeleteDoc(doc.Id); err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := a.fs.RemoveThumbnails(context.Background(), doc.Id); err != nil {
+		log.Error(err)
+	}
+
+	a.cache.Ch <- SyncDocs
+
+	render.JSON(w, r, Response{
+		Response: render.M{
+			strconv.FormatInt(doc.Id, 10): true,
+		},
+	})
+}
+
+func (a *Api) userUnlock(w http.ResponseWriter, r *http.Request) {
+	login := chi.URLParam(r, "login")
+	a.loginLimiter.Reset(login)
+	if ip := r.URL.Query().Get("ip"); ip != "" {
+		a.loginLimiter.Reset(login + "|" + ip)
+		a.ipLimiter.Reset(ip)
+	}
+
+	render.JSON(w, r, Response{
+		Response: render.M{
+			login: true,
+		},
+	})
+}
+
+// userIdpLink lets the user log in with JWTs of the subject, the only way a JWT reaches an existing account.
+func (a *Api) userIdpLink(w http.ResponseWriter, r *http.Request) {
+	var input IdpLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to decode json body. Error: %s ", err))
+		return
+	}
+	_, sub, found := strings.Cut(input.Subject, jwtSubjectSeparator)
+	if !found || sub == "" || len(sub) > maxLoginClaimLen || len(input.Subject) > 512 {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Subject must be iss%ssub", jwtSubjectSeparator))
+		return
+	}
+
+	user := a.urlUser(w, r)
+	if user == nil {
+		return
+	}
+	if linked, err := a.db.GetUserBySubject(input.Subject); err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	} else if linked != nil && linked.Id != user.Id {
+		a.writeError(w, r, http.StatusConflict, fmt.Sprintf("Subject is linked to %s", linked.Login))
+		return
+	}
+
+	if err := a.db.SetUserIdpSubject(user.Id, &input.Subject); err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"login":   user.Login,
+			"subject": input.Subject,
+		},
+	})
+}
+
+func (a *Api) userIdpUnlink(w http.ResponseWriter, r *http.Request) {
+	user := a.urlUser(w, r)
+	if user == nil {
+		return
+	}
+
+	if err := a.db.SetUserIdpSubject(user.Id, nil); err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"login": user.Login,
+		},
+	})
+}
+
+func (a *Api) userRole(w http.ResponseWriter, r *http.Request) {
+	var input RoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to decode json body. Error: %s ", err))
+		return
+	}
+	if !IsRole(input.Role) {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Role must be one of %v", Roles))
+		return
+	}
+
+	user := a.urlUser(w, r)
+	if user == nil {
+		return
+	}
+
+	ok, err := a.db.SetUserRole(user.Id, input.Role)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		a.writeError(w, r, http.StatusConflict, "The last admin can't be demoted")
+		return
+	}
+
+	a.cache.Ch <- SyncTokens
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"login": user.Login,
+			"role":  input.Role,
+		},
+	})
+}
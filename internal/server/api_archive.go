@@ -0,0 +1,547 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/render"
+	"github.com/minio/minio-go/v7"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+func docFilter(key string, value string) (func(Doc) bool, error) {
+	switch key {
+	case "name":
+		return func(d Doc) bool { return d.Filename == value }, nil
+	case "mime":
+		return func(d Doc) bool { return d.Mime == value }, nil
+	case "public":
+		public, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("Filter value for public must be boolean ")
+		}
+		return func(d Doc) bool { return d.Public == public }, nil
+	}
+	return nil, fmt.Errorf("Unknown filter key %s ", key)
+}
+
+// zipEntryName keeps archive entries inside the archive root whatever the document name is.
+func zipEntryName(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(name, "\\", "/")), "/")
+	if name == "" {
+		name = "_"
+	}
+	return "files/" + name
+}
+
+func (a *Api) docsZip(w http.ResponseWriter, r *http.Request) {
+	usertoken := userToken(r)
+
+	var input DocsZipRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to decode json body. Error: %s ", err))
+		return
+	}
+
+	var docs []Doc
+	switch {
+	case len(input.Ids) > 0:
+		for _, id := range input.Ids {
+			// docs the caller can't read look missing, so ids of foreign docs can't be probed
+			doc, ok := a.cache.getDocByID(id)
+			if !ok || doc.Status != DocStatusClean || !canRead(usertoken, doc) {
+				a.writeError(w, r, http.StatusNotFound, fmt.Sprintf("File %d doesn't exist", id))
+				return
+			}
+			docs = append(docs, doc)
+		}
+	case input.Key != "":
+		match, err := docFilter(input.Key, input.Value)
+		if err != nil {
+			a.writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		for _, doc := range a.cache.getDocs() {
+			if doc.Status == DocStatusClean && canRead(usertoken, doc) && match(doc) {
+				docs = append(docs, doc)
+			}
+		}
+	default:
+		a.writeError(w, r, http.StatusBadRequest, "Either ids or key filter must be set")
+		return
+	}
+
+	manifest := make([]DocResponse, 0, len(docs))
+	for _, doc := range docs {
+		manifest = append(manifest, NewDocResponse(doc))
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="docs.zip"`)
+
+	// the response is already streaming, so errors can only be logged from here on
+	zw := zip.NewWriter(w)
+	defer func() {
+		if err := zw.Close(); err != nil {
+			log.Errorf("Failed to finish zip archive. Error: %s", err)
+		}
+	}()
+
+	mw, err := zw.Create("manifest.json")
+	if err != nil {
+		log.Errorf("Failed to add manifest to zip. Error: %s", err)
+		return
+	}
+	if err := json.NewEncoder(mw).Encode(manifest); err != nil {
+		log.Errorf("Failed to write manifest to zip. Error: %s", err)
+		return
+	}
+
+	for _, doc := range docs {
+		if err := a.writeZipEntry(zw, doc); err != nil {
+			log.Error(err)
+			return
+		}
+	}
+}
+
+func (a *Api) writeZipEntry(zw *zip.Writer, doc Doc) error {
+	object, err := a.fs.client.GetObject(context.Background(), MinioBucketName, doc.ObjectKey, minio.GetObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("Failed to get file from minio. Error: %s ", err)
+	}
+	defer object.Close()
+
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     zipEntryName(doc.Filename),
+		Method:   zip.Deflate,
+		Modified: doc.Modified,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to add file %d to zip. Error: %s ", doc.Id, err)
+	}
+
+	if _, err := io.Copy(fw, object); err != nil {
+		return fmt.Errorf("Failed to write file %d to zip. Error: %s ", doc.Id, err)
+	}
+	return nil
+}
+
+const (
+	ImportModeAtomic     = "atomic"
+	ImportModeBestEffort = "best_effort"
+
+	maxImportArchiveSize   = 2 << 30
+	maxImportEntries       = 10000
+	maxImportEntrySize     = 100 << 20
+	maxImportTotalSize     = 4 << 30
+	maxImportCompressRatio = 200
+)
+
+type ImportResult struct {
+	Name   string `json:"name"`
+	Id     int64  `json:"id,omitempty"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// importEntryName validates an archive entry path. Empty name means the entry should be skipped.
+func importEntryName(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return "", fmt.Errorf("Absolute paths are not allowed ")
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("Path traversal is not allowed ")
+		}
+	}
+	name = path.Clean(name)
+	if name == "." {
+		return "", nil
+	}
+	if len(name) > 255 {
+		return "", fmt.Errorf("Name is too long ")
+	}
+	return name, nil
+}
+
+// walkArchive calls fn for every regular file of a zip or tar (optionally gzipped) archive.
+// Entry contents are limited to maxImportEntrySize whatever the headers claim.
+func walkArchive(f *os.File, size int64, fn func(name string, r io.Reader) error) error {
+	magic := make([]byte, 4)
+	if _, err := f.ReadAt(magic, 0); err != nil && err != io.EOF {
+		return fmt.Errorf("Failed to read archive. Error: %s ", err)
+	}
+
+	if bytes.Equal(magic, []byte("PK\x03\x04")) {
+		zr, err := zip.NewReader(f, size)
+		if err != nil {
+			return fmt.Errorf("Failed to open zip archive. Error: %s ", err)
+		}
+		if len(zr.File) > maxImportEntries {
+			return fmt.Errorf("Archive has more than %d entries ", maxImportEntries)
+		}
+		for _, zf := range zr.File {
+			if zf.FileInfo().IsDir() {
+				continue
+			}
+			if zf.UncompressedSize64 > maxImportEntrySize ||
+				(zf.CompressedSize64 > 0 && zf.UncompressedSize64/zf.CompressedSize64 > maxImportCompressRatio) {
+				if err := fn(zf.Name, errReader{fmt.Errorf("Entry is too large ")}); err != nil {
+					return err
+				}
+				continue
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				rc = io.NopCloser(errReader{fmt.Errorf("Failed to open entry. Error: %s ", err)})
+			}
+			err = fn(zf.Name, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("Failed to read archive. Error: %s ", err)
+	}
+	var r io.Reader = f
+	if bytes.HasPrefix(magic, []byte("\x1f\x8b")) {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("Failed to open gzip archive. Error: %s ", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for entries := 0; ; {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to read tar archive. Error: %s ", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if entries++; entries > maxImportEntries {
+			return fmt.Errorf("Archive has more than %d entries ", maxImportEntries)
+		}
+		if err := fn(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+type errReader struct {
+	err error
+}
+
+func (e errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+func readImportEntry(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxImportEntrySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImportEntrySize {
+		return nil, fmt.Errorf("Entry is larger than %d bytes ", maxImportEntrySize)
+	}
+	return data, nil
+}
+
+func importMime(name string, data []byte) string {
+	if m := mime.TypeByExtension(path.Ext(name)); m != "" {
+		return m
+	}
+	return http.DetectContentType(data)
+}
+
+func (a *Api) docsImport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	usertoken := userToken(r)
+
+	mode := query.Get("mode")
+	if mode == "" {
+		mode = ImportModeBestEffort
+	}
+	if mode != ImportModeAtomic && mode != ImportModeBestEffort {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Mode must be %s or %s", ImportModeAtomic, ImportModeBestEffort))
+		return
+	}
+
+	var public bool
+	var err error
+	if publicParam := query.Get("public"); publicParam != "" {
+		public, err = strconv.ParseBool(publicParam)
+		if err != nil {
+			a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Public parameter must be boolean. Error: %s", err))
+			return
+		}
+	}
+	var grant []GrantSpec
+	for _, g := range query["grant"] {
+		spec, err := ParseGrantSpec(g)
+		if err != nil {
+			a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid grant %q. Error: %s", g, err))
+			return
+		}
+		grant = append(grant, spec)
+	}
+	if !a.checkGrantees(w, r, grant) {
+		return
+	}
+
+	f, err := os.CreateTemp("", "import-*")
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Failed to create temp file. Error: %s ", err))
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	size, err := io.Copy(f, http.MaxBytesReader(w, r.Body, maxImportArchiveSize))
+	if err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to read archive. Error: %s ", err))
+		return
+	}
+
+	newDoc := func(name string, data []byte) NewDoc {
+		return NewDoc{
+			Filename: name,
+			Public:   public,
+			Mime:     importMime(name, data),
+			OwnerId:  usertoken.UserID,
+			Grant:    grant,
+		}
+	}
+
+	if mode == ImportModeAtomic {
+		a.importAtomic(w, r, f, size, newDoc)
+	} else {
+		a.importBestEffort(w, r, f, size, newDoc)
+	}
+}
+
+func (a *Api) writeImportResult(w http.ResponseWriter, r *http.Request, httpStatus int, msg string, results []ImportResult) {
+	resp := Response{
+		Data: render.M{
+			"docs": results,
+		},
+	}
+	if msg != "" {
+		log.Error(msg)
+		resp.Error = &ResponseError{
+			Code: httpStatus,
+			Text: msg,
+		}
+	}
+	render.Status(r, httpStatus)
+	render.JSON(w, r, resp)
+}
+
+func (a *Api) importBestEffort(w http.ResponseWriter, r *http.Request, f *os.File, size int64, newDoc func(string, []byte) NewDoc) {
+	results := make([]ImportResult, 0)
+	names := make(map[string]bool)
+	var total int64
+	walkErr := walkArchive(f, size, func(entryName string, er io.Reader) error {
+		name, err := importEntryName(entryName)
+		if err != nil {
+			results = append(results, ImportResult{Name: entryName, Error: err.Error()})
+			return nil
+		}
+		if name == "" {
+			return nil
+		}
+
+		result := ImportResult{Name: name}
+		defer func() { results = append(results, result) }()
+
+		// cache is synced only after the import, so duplicates inside the archive are tracked here
+		if _, ok := a.cache.getDoc(name); ok || names[name] {
+			result.Error = fmt.Sprintf("File %s exists", name)
+			return nil
+		}
+		if !userToken(r).InDocPrefix(name) {
+			result.Error = "File name is outside of the API key prefix"
+			return nil
+		}
+		names[name] = true
+
+		data, err := readImportEntry(er)
+		if err != nil {
+			result.Error = err.Error()
+			return nil
+		}
+		if total += int64(len(data)); total > maxImportTotalSize {
+			return fmt.Errorf("Archive is larger than %d bytes unpacked ", int64(maxImportTotalSize))
+		}
+
+		result.Id, result.Status, err = a.storeDoc(newDoc(name, data), data)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		return nil
+	})
+
+	a.cache.Ch <- SyncDocs
+
+	if walkErr != nil {
+		a.writeImportResult(w, r, http.StatusBadRequest, walkErr.Error(), results)
+		return
+	}
+	a.writeImportResult(w, r, http.StatusOK, "", results)
+}
+
+// importAtomic validates the whole archive first, then stores every file and creates all docs
+// in one transaction. Stored objects are removed if anything fails. Every file has to be scanned clean,
+// a scanner failure fails the import instead of leaving a part of the archive in quarantine.
+func (a *Api) importAtomic(w http.ResponseWriter, r *http.Request, f *os.File, size int64, newDoc func(string, []byte) NewDoc) {
+	results := make([]ImportResult, 0)
+	names := make(map[string]bool)
+	failed := false
+	var total int64
+
+	walkErr := walkArchive(f, size, func(entryName string, er io.Reader) error {
+		name, err := importEntryName(entryName)
+		if err != nil {
+			failed = true
+			results = append(results, ImportResult{Name: entryName, Error: err.Error()})
+			return nil
+		}
+		if name == "" {
+			return nil
+		}
+
+		result := ImportResult{Name: name}
+		defer func() {
+			failed = failed || result.Error != ""
+			results = append(results, result)
+		}()
+
+		if _, ok := a.cache.getDoc(name); ok || names[name] {
+			result.Error = fmt.Sprintf("File %s exists", name)
+			return nil
+		}
+		if !userToken(r).InDocPrefix(name) {
+			result.Error = "File name is outside of the API key prefix"
+			return nil
+		}
+		names[name] = true
+
+		n, err := io.Copy(io.Discard, io.LimitReader(er, maxImportEntrySize+1))
+		if err != nil {
+			result.Error = err.Error()
+			return nil
+		}
+		if n > maxImportEntrySize {
+			result.Error = fmt.Sprintf("Entry is larger than %d bytes ", maxImportEntrySize)
+			return nil
+		}
+		if total += n; total > maxImportTotalSize {
+			return fmt.Errorf("Archive is larger than %d bytes unpacked ", int64(maxImportTotalSize))
+		}
+		return nil
+	})
+	if walkErr != nil {
+		a.writeImportResult(w, r, http.StatusBadRequest, walkErr.Error(), results)
+		return
+	}
+	if failed {
+		a.writeImportResult(w, r, http.StatusUnprocessableEntity, "Archive has invalid entries, nothing was imported", results)
+		return
+	}
+
+	results = make([]ImportResult, 0, len(names))
+	docs := make([]NewDoc, 0, len(names))
+	var stored []string
+	var scanErr error
+	cleanup := func() {
+		for _, key := range stored {
+			err := a.fs.client.RemoveObject(context.Background(), MinioBucketName, key, minio.RemoveObjectOptions{})
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}
+
+	walkErr = walkArchive(f, size, func(entryName string, er io.Reader) error {
+		name, _ := importEntryName(entryName)
+		if name == "" {
+			return nil
+		}
+
+		data, err := readImportEntry(er)
+		if err != nil {
+			return fmt.Errorf("Failed to read %s. Error: %s ", name, err)
+		}
+
+		doc := newDoc(name, data)
+		doc.Status = DocStatusClean
+		result, err := a.scanner.Scan(context.Background(), bytes.NewReader(data))
+		if err != nil {
+			scanErr = fmt.Errorf("Failed to scan %s. Error: %s ", name, err)
+			return scanErr
+		} else if !result.Clean {
+			return fmt.Errorf("File %s is infected: %s ", name, result.Signature)
+		}
+
+		if doc.ObjectKey, err = GenerateSecureToken(); err != nil {
+			return err
+		}
+		doc.Size = int64(len(data))
+		doc.Hash = ContentHash(data)
+		if err := a.fs.Put(context.Background(), MinioBucketName, doc.ObjectKey, data, doc.Mime); err != nil {
+			return err
+		}
+		stored = append(stored, doc.ObjectKey)
+		docs = append(docs, doc)
+		return nil
+	})
+	if walkErr != nil {
+		cleanup()
+		status := http.StatusUnprocessableEntity
+		if walkErr == scanErr {
+			status = http.StatusServiceUnavailable
+		}
+		a.writeImportResult(w, r, status, walkErr.Error()+", nothing was imported", results)
+		return
+	}
+
+	ids, err := a.db.CreateDocs(docs)
+	if err != nil {
+		cleanup()
+		a.writeImportResult(w, r, http.StatusInternalServerError, err.Error(), results)
+		return
+	}
+
+	for i, doc := range docs {
+		results = append(results, ImportResult{Name: doc.Filename, Id: ids[i], Status: doc.Status})
+		if doc.Status == DocStatusClean {
+			a.enqueueProcessing(Doc{Id: ids[i], Filename: doc.Filename, Mime: doc.Mime, ObjectKey: doc.ObjectKey})
+		}
+	}
+
+	a.cache.Ch <- SyncDocs
+	a.writeImportResult(w, r, http.StatusOK, "", results)
+}
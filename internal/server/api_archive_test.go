@@ -0,0 +1,206 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportEntryName(t *testing.T) {
+	tests := []struct {
+		entry string
+		name  string
+		err   bool
+	}{
+		{"docs/report.pdf", "docs/report.pdf", false},
+		{"./docs//report.pdf", "docs/report.pdf", false},
+		{"docs\\report.pdf", "docs/report.pdf", false},
+		{"docs/", "docs", false},
+		{"./", "", false},
+		{"../x", "", true},
+		{"a/../../b", "", true},
+		{"a/../b", "", true},
+		{"..\\x", "", true},
+		{"/abs", "", true},
+		{"\\abs", "", true},
+		{"C:\\windows\\x", "", true},
+		{strings.Repeat("a", 256), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			name, err := importEntryName(tt.entry)
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if name != tt.name {
+				t.Fatalf("expected %q, got %q", tt.name, name)
+			}
+		})
+	}
+}
+
+// writeArchive stores the archive built by build into a temp file the way docsImport does.
+func writeArchive(t *testing.T, build func(w io.Writer)) (*os.File, int64) {
+	t.Helper()
+	var buf bytes.Buffer
+	build(&buf)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return f, int64(buf.Len())
+}
+
+// collectArchive walks the archive and returns entry contents or read errors by entry name.
+func collectArchive(f *os.File, size int64) (map[string]string, error) {
+	entries := make(map[string]string)
+	err := walkArchive(f, size, func(name string, r io.Reader) error {
+		data, err := readImportEntry(r)
+		if err != nil {
+			entries[name] = "error: " + err.Error()
+			return nil
+		}
+		entries[name] = string(data)
+		return nil
+	})
+	return entries, err
+}
+
+func TestWalkArchiveZip(t *testing.T) {
+	bomb := bytes.Repeat([]byte{0}, 1<<20)
+	f, size := writeArchive(t, func(w io.Writer) {
+		zw := zip.NewWriter(w)
+		zw.Create("dir/")
+		fw, _ := zw.Create("dir/a.txt")
+		fw.Write([]byte("hello"))
+		fw, _ = zw.Create("bomb.bin")
+		fw.Write(bomb)
+
+		// the header claims more than an entry may have, the content itself is never read
+		fw, _ = zw.CreateRaw(&zip.FileHeader{
+			Name:               "huge.bin",
+			Method:             zip.Store,
+			CRC32:              crc32.ChecksumIEEE([]byte("x")),
+			CompressedSize64:   1,
+			UncompressedSize64: maxImportEntrySize + 1,
+		})
+		fw.Write([]byte("x"))
+		zw.Close()
+	})
+
+	entries, err := collectArchive(f, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 files, got %v", entries)
+	}
+	if entries["dir/a.txt"] != "hello" {
+		t.Fatalf("unexpected content %q", entries["dir/a.txt"])
+	}
+	for _, name := range []string{"bomb.bin", "huge.bin"} {
+		if !strings.Contains(entries[name], "Entry is too large") {
+			t.Fatalf("%s: expected size error, got %.40q", name, entries[name])
+		}
+	}
+}
+
+func TestWalkArchiveTar(t *testing.T) {
+	files := map[string]string{"a.txt": "hello", "dir/b.txt": "world"}
+	build := func(w io.Writer) {
+		tw := tar.NewWriter(w)
+		tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755})
+		tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"})
+		for name, content := range files {
+			tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+			tw.Write([]byte(content))
+		}
+		tw.Close()
+	}
+
+	tests := []struct {
+		name  string
+		build func(w io.Writer)
+	}{
+		{"tar", build},
+		{"tar.gz", func(w io.Writer) {
+			gz := gzip.NewWriter(w)
+			build(gz)
+			gz.Close()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := collectArchive(writeArchive(t, tt.build))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(files) {
+				t.Fatalf("expected only regular files, got %v", entries)
+			}
+			for name, content := range files {
+				if entries[name] != content {
+					t.Fatalf("%s: expected %q, got %q", name, content, entries[name])
+				}
+			}
+		})
+	}
+}
+
+func TestWalkArchiveTarEntries(t *testing.T) {
+	build := func(n int) func(w io.Writer) {
+		return func(w io.Writer) {
+			tw := tar.NewWriter(w)
+			for i := 0; i < n; i++ {
+				tw.WriteHeader(&tar.Header{Name: "f" + strings.Repeat("x", i%50), Typeflag: tar.TypeReg, Mode: 0644})
+			}
+			tw.Close()
+		}
+	}
+
+	var walked int
+	f, size := writeArchive(t, build(maxImportEntries))
+	err := walkArchive(f, size, func(string, io.Reader) error { walked++; return nil })
+	if err != nil || walked != maxImportEntries {
+		t.Fatalf("expected %d entries to pass, got %d, %v", maxImportEntries, walked, err)
+	}
+
+	walked = 0
+	f, size = writeArchive(t, build(maxImportEntries+1))
+	err = walkArchive(f, size, func(string, io.Reader) error { walked++; return nil })
+	if err == nil || !strings.Contains(err.Error(), "more than") {
+		t.Fatalf("expected entry limit error, got %v", err)
+	}
+	if walked != maxImportEntries {
+		t.Fatalf("walk must stop at the limit, got %d entries", walked)
+	}
+}
+
+func TestWalkArchiveZipEntries(t *testing.T) {
+	f, size := writeArchive(t, func(w io.Writer) {
+		zw := zip.NewWriter(w)
+		for i := 0; i <= maxImportEntries; i++ {
+			zw.Create("f")
+		}
+		zw.Close()
+	})
+	err := walkArchive(f, size, func(string, io.Reader) error {
+		t.Fatal("no entry may be walked when the zip has too many")
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "more than") {
+		t.Fatalf("expected entry limit error, got %v", err)
+	}
+}
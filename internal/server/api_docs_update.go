@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/render"
+	"github.com/minio/minio-go/v7"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const maxDocNameLength = 255
+
+func docETag(doc Doc) string {
+	return fmt.Sprintf(`"v%d"`, doc.Version)
+}
+
+// ifMatchVersions parses an If-Match header into doc versions, nil means any version matches.
+// Weak and foreign tags never match, so an empty slice is returned for them.
+func ifMatchVersions(header string) []int64 {
+	versions := make([]int64, 0)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return nil
+		}
+		if !strings.HasPrefix(tag, `"v`) || !strings.HasSuffix(tag, `"`) {
+			continue
+		}
+		if version, err := strconv.ParseInt(tag[2:len(tag)-1], 10, 64); err == nil {
+			versions = append(versions, version)
+		}
+	}
+	return versions
+}
+
+func jsonOrEmpty(data *string) interface{} {
+	if data == nil {
+		return render.M{}
+	}
+	return json.RawMessage(*data)
+}
+
+func (a *Api) docsPatch(w http.ResponseWriter, r *http.Request) {
+	var input DocPatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to decode json body. Error: %s ", err))
+		return
+	}
+
+	doc, ok := a.sharedDoc(w, r)
+	if !ok {
+		return
+	}
+	usertoken := userToken(r)
+	if !can(usertoken, *doc, PermWrite) {
+		a.writeError(w, r, http.StatusForbidden, "No write permission for the file")
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		a.writeError(w, r, http.StatusPreconditionRequired, "If-Match header with the doc ETag is required")
+		return
+	}
+
+	var update DocMetaUpdate
+	if input.Name != nil && *input.Name != doc.Filename {
+		name := *input.Name
+		if name == "" || len(name) > maxDocNameLength {
+			a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Name must be from 1 to %d characters", maxDocNameLength))
+			return
+		}
+		if !usertoken.InDocPrefix(name) {
+			a.writeError(w, r, http.StatusForbidden, "File name is outside of the API key prefix")
+			return
+		}
+		if _, exists := a.cache.getDoc(name); exists {
+			a.writeError(w, r, http.StatusConflict, fmt.Sprintf("File %s exists", name))
+			return
+		}
+		update.Filename = &name
+	}
+	if input.Mime != nil && *input.Mime != doc.Mime {
+		if *input.Mime == "" {
+			a.writeError(w, r, http.StatusBadRequest, "Mime can't be empty")
+			return
+		}
+		update.Mime = input.Mime
+	}
+	if len(input.Json) > 0 {
+		update.SetJson = true
+		if string(input.Json) != "null" {
+			data := string(input.Json)
+			update.Json = &data
+		}
+	}
+
+	version, ok, err := a.db.UpdateDocMeta(doc.Id, ifMatchVersions(ifMatch), update)
+	if err == errDocExists {
+		a.writeError(w, r, http.StatusConflict, fmt.Sprintf("File %s exists", *update.Filename))
+		return
+	}
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		a.writeError(w, r, http.StatusPreconditionFailed, "File was changed by someone else, get it again and retry")
+		return
+	}
+
+	updated := *doc
+	updated.Version = version
+	if update.Filename != nil {
+		updated.Filename = *update.Filename
+	}
+	if version == doc.Version {
+		// nothing changed, the doc and its ETag stay the same
+		w.Header().Set("ETag", docETag(updated))
+		render.JSON(w, r, Response{
+			Data: render.M{
+				"doc": NewDocResponse(updated),
+			},
+		})
+		return
+	}
+	if update.Mime != nil {
+		updated.Mime = *update.Mime
+		a.reprocessDoc(updated)
+	}
+
+	a.cache.Ch <- SyncDocs
+	w.Header().Set("ETag", docETag(updated))
+	render.JSON(w, r, Response{
+		Data: render.M{
+			"doc": NewDocResponse(updated),
+		},
+	})
+}
+
+// docsPut replaces the content of the doc under the same id, so grants and share links stay valid.
+// The new content is scanned before anything changes and stored under a new key, the old object
+// is removed only after the doc points to the new one. If-Match is required, as in docsPatch.
+func (a *Api) docsPut(w http.ResponseWriter, r *http.Request) {
+	var input DocPutRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to decode json body. Error: %s ", err))
+		return
+	}
+
+	doc, ok := a.sharedDoc(w, r)
+	if !ok {
+		return
+	}
+	if !can(userToken(r), *doc, PermWrite) {
+		a.writeError(w, r, http.StatusForbidden, "No write permission for the file")
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		a.writeError(w, r, http.StatusPreconditionRequired, "If-Match header with the doc ETag is required")
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString(input.File.Data)
+	if err != nil {
+		a.writeError(w, r, http.StatusBadRequest, "Failed to decode string from base64")
+		return
+	}
+
+	content := DocContent{
+		Mime:   doc.Mime,
+		Size:   int64(len(data)),
+		Hash:   ContentHash(data),
+		Status: DocStatusClean,
+	}
+	if input.Mime != "" {
+		content.Mime = input.Mime
+	}
+
+	// infected content is rejected right away, the doc keeps its current content
+	result, err := a.scanner.Scan(context.Background(), bytes.NewReader(data))
+	if err != nil {
+		log.Errorf("Failed to scan new content of doc %d. Error: %s", doc.Id, err)
+		content.Status = DocStatusPending
+	} else if !result.Clean {
+		log.Warnf("New content of doc %d rejected, signature: %s", doc.Id, result.Signature)
+		a.writeError(w, r, http.StatusUnprocessableEntity, fmt.Sprintf("File is infected: %s", result.Signature))
+		return
+	}
+
+	content.ObjectKey, err = GenerateSecureToken()
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := a.fs.Put(context.Background(), MinioBucketName, content.ObjectKey, data, content.Mime); err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	version, modified, ok, err := a.db.ReplaceDocContent(doc.Id, ifMatchVersions(ifMatch), content)
+	if err != nil || !ok {
+		if rmErr := a.fs.client.RemoveObject(context.Background(), MinioBucketName, content.ObjectKey, minio.RemoveObjectOptions{}); rmErr != nil {
+			log.Error(rmErr)
+		}
+		if err != nil {
+			a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		} else {
+			a.writeError(w, r, http.StatusPreconditionFailed, "File was changed by someone else, get it again and retry")
+		}
+		return
+	}
+
+	if err := a.fs.client.RemoveObject(context.Background(), MinioBucketName, doc.ObjectKey, minio.RemoveObjectOptions{}); err != nil {
+		log.Error(err)
+	}
+	if err := a.fs.RemoveThumbnails(context.Background(), doc.Id); err != nil {
+		log.Error(err)
+	}
+	if err := a.db.DeleteDocText(doc.Id); err != nil {
+		log.Error(err)
+	}
+
+	updated := *doc
+	updated.ObjectKey = content.ObjectKey
+	updated.Mime = content.Mime
+	updated.Size = content.Size
+	updated.Hash = content.Hash
+	updated.Status = content.Status
+	updated.Modified = modified
+	updated.Version = version
+	if updated.Status == DocStatusClean {
+		a.enqueueProcessing(updated)
+	}
+
+	a.cache.Ch <- SyncDocs
+	w.Header().Set("ETag", docETag(updated))
+	render.JSON(w, r, Response{
+		Data: render.M{
+			"doc":    NewDocResponse(updated),
+			"status": updated.Status,
+		},
+	})
+}
+
+func (a *Api) reprocessDoc(doc Doc) {
+	if !IsImageMime(doc.Mime) {
+		if err := a.fs.RemoveThumbnails(context.Background(), doc.Id); err != nil {
+			log.Error(err)
+		}
+	}
+	if textExtractor(doc.Mime) == nil {
+		if err := a.db.DeleteDocText(doc.Id); err != nil {
+			log.Error(err)
+		}
+	}
+	a.enqueueProcessing(doc)
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"net/http"
+	"regexp"
+)
+
+var groupNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+func (a *Api) managedGroup(w http.ResponseWriter, r *http.Request) *Group {
+	name := chi.URLParam(r, "name")
+	group, err := a.db.GetGroup(name)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return nil
+	}
+	if group == nil {
+		a.writeError(w, r, http.StatusNotFound, fmt.Sprintf("Group %s not found", name))
+		return nil
+	}
+
+	usertoken := userToken(r)
+	if group.OwnerId != usertoken.UserID && !usertoken.HasScope(ScopeAdmin) {
+		a.writeError(w, r, http.StatusForbidden, "Only the group owner can change the group")
+		return nil
+	}
+	return group
+}
+
+func visibleGroup(ut *UserToken, group Group) bool {
+	if group.OwnerId == ut.UserID || ut.HasScope(ScopeAdmin) {
+		return true
+	}
+	for _, gid := range ut.GroupIds {
+		if gid == group.Id {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Api) groupsList(w http.ResponseWriter, r *http.Request) {
+	groups, err := a.db.GetGroups()
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	usertoken := userToken(r)
+	resp := make([]GroupResponse, 0, len(groups))
+	for _, group := range groups {
+		if visibleGroup(usertoken, group) {
+			resp = append(resp, NewGroupResponse(group))
+		}
+	}
+
+	render.JSON(w, r, Response{
+		Data: render.M{
+			"groups": resp,
+		},
+	})
+}
+
+func (a *Api) groupsCreate(w http.ResponseWriter, r *http.Request) {
+	var input GroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to decode json body. Error: %s ", err))
+		return
+	}
+	if !groupNameRe.MatchString(input.Name) {
+		a.writeError(w, r, http.StatusBadRequest, "Group name must be 1-64 latin letters, digits, '_', '.' or '-'")
+		return
+	}
+
+	existing, err := a.db.GetGroup(input.Name)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if existing != nil {
+		a.writeError(w, r, http.StatusConflict, fmt.Sprintf("Group %s exists", input.Name))
+		return
+	}
+
+	if err := a.db.CreateGroup(input.Name, userToken(r).UserID); err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"name": input.Name,
+		},
+	})
+}
+
+func (a *Api) groupsDelete(w http.ResponseWriter, r *http.Request) {
+	group := a.managedGroup(w, r)
+	if group == nil {
+		return
+	}
+
+	if err := a.db.DeleteGroup(group.Id); err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.cache.Ch <- SyncTokens
+	a.cache.Ch <- SyncDocs
+	render.JSON(w, r, Response{
+		Response: render.M{
+			group.Name: true,
+		},
+	})
+}
+
+func (a *Api) groupMembersAdd(w http.ResponseWriter, r *http.Request) {
+	var input GroupMembersRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to decode json body. Error: %s ", err))
+		return
+	}
+	if len(input.Logins) == 0 {
+		a.writeError(w, r, http.StatusBadRequest, "Logins are required")
+		return
+	}
+
+	group := a.managedGroup(w, r)
+	if group == nil {
+		return
+	}
+
+	unresolved, err := a.db.AddGroupMembers(group.Id, input.Logins)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// membership is part of the cached identity
+	a.cache.Ch <- SyncTokens
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"name":       group.Name,
+			"unresolved": unresolved,
+		},
+	})
+}
+
+func (a *Api) groupMembersDelete(w http.ResponseWriter, r *http.Request) {
+	group := a.managedGroup(w, r)
+	if group == nil {
+		return
+	}
+
+	login := chi.URLParam(r, "login")
+	ok, err := a.db.RemoveGroupMember(group.Id, login)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		a.writeError(w, r, http.StatusNotFound, fmt.Sprintf("User %s is not a member of %s", login, group.Name))
+		return
+	}
+
+	a.cache.Ch <- SyncTokens
+	render.JSON(w, r, Response{
+		Response: render.M{
+			login: true,
+		},
+	})
+}
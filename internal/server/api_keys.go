@@ -0,0 +1,230 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const apiKeyPrefix = "ak_"
+
+const (
+	ScopeDocsRead   = "docs:read"
+	ScopeDocsWrite  = "docs:write"
+	ScopeDocsDelete = "docs:delete"
+	ScopeAdmin      = "admin"
+)
+
+var apiKeyScopes = []string{ScopeDocsRead, ScopeDocsWrite, ScopeDocsDelete, ScopeAdmin}
+
+// HasScope reports whether the credential allows the action. The role of the user limits every credential,
+// API keys are limited further by their scopes.
+func (ut *UserToken) HasScope(scope string) bool {
+	if !RoleAllows(ut.Role, scope) {
+		return false
+	}
+	if ut.APIKeyID == 0 {
+		return true
+	}
+	for _, s := range ut.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (ut *UserToken) InDocPrefix(filename string) bool {
+	return strings.HasPrefix(filename, ut.DocPrefix)
+}
+
+func (a *Api) apiKeyIdentity(requestToken string) (*UserToken, error) {
+	keyHash := HashToken(requestToken)
+	key, ok := a.cache.GetAPIKey(keyHash)
+	if !ok || key.KeyHash != keyHash {
+		return nil, fmt.Errorf("API key doesn't exist. ")
+	}
+	if key.Disabled {
+		return nil, fmt.Errorf("User is disabled. ")
+	}
+
+	now := time.Now().UTC()
+	if now.Sub(key.LastUsedAt) >= tokenTouchInterval {
+		a.cache.TouchAPIKey(keyHash, now)
+		go func() {
+			if err := a.db.TouchAPIKey(keyHash, now); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+
+	return &UserToken{
+		UserID:     key.UserId,
+		Login:      key.Login,
+		TokenHash:  key.KeyHash,
+		IssuedAt:   key.CreatedAt,
+		LastUsedAt: now,
+		APIKeyID:   key.Id,
+		Scopes:     key.Scopes,
+		DocPrefix:  key.DocPrefix,
+		Role:       key.Role,
+
+		TotpEnabled:  key.TotpEnabled,
+		TotpRequired: key.TotpRequired,
+	}, nil
+}
+
+func validateScopes(scopes []string, role string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("At least one scope is required, one of %v", apiKeyScopes)
+	}
+	for _, scope := range scopes {
+		known := false
+		for _, s := range apiKeyScopes {
+			known = known || s == scope
+		}
+		if !known {
+			return fmt.Errorf("Unknown scope %s, must be one of %v", scope, apiKeyScopes)
+		}
+		if !RoleAllows(role, scope) {
+			return fmt.Errorf("Role %s doesn't allow scope %s", role, scope)
+		}
+	}
+	return nil
+}
+
+func (a *Api) createAPIKey(w http.ResponseWriter, r *http.Request, userId int64, role string) {
+	var input APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to decode json body. Error: %s ", err))
+		return
+	}
+
+	if err := validateScopes(input.Scopes, role); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(input.DocPrefix) > 255 {
+		a.writeError(w, r, http.StatusBadRequest, "Doc prefix is too long")
+		return
+	}
+
+	plain, key, err := a.db.CreateAPIKey(userId, input.Name, input.Scopes, input.DocPrefix)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.cache.Ch <- SyncTokens
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"key":     plain,
+			"api_key": NewAPIKeyResponse(*key),
+		},
+	})
+}
+
+func (a *Api) listAPIKeys(w http.ResponseWriter, r *http.Request, userId int64) {
+	keys, err := a.db.GetUserAPIKeys(userId)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := make([]APIKeyResponse, 0, len(keys))
+	for _, key := range keys {
+		resp = append(resp, NewAPIKeyResponse(key))
+	}
+
+	render.JSON(w, r, Response{
+		Data: render.M{
+			"api_keys": resp,
+		},
+	})
+}
+
+func (a *Api) revokeAPIKey(w http.ResponseWriter, r *http.Request, userId int64) {
+	idParam := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("API key id parameter must be integer. Error: %s", err))
+		return
+	}
+
+	ok, err := a.db.DeleteAPIKey(userId, id)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		a.writeError(w, r, http.StatusNotFound, "API key doesn't exist")
+		return
+	}
+
+	a.cache.Ch <- SyncTokens
+	render.JSON(w, r, Response{
+		Response: render.M{
+			idParam: true,
+		},
+	})
+}
+
+func (a *Api) apiKeysCreate(w http.ResponseWriter, r *http.Request) {
+	usertoken := userToken(r)
+	a.createAPIKey(w, r, usertoken.UserID, usertoken.Role)
+}
+
+func (a *Api) apiKeysList(w http.ResponseWriter, r *http.Request) {
+	a.listAPIKeys(w, r, userToken(r).UserID)
+}
+
+func (a *Api) apiKeysDelete(w http.ResponseWriter, r *http.Request) {
+	a.revokeAPIKey(w, r, userToken(r).UserID)
+}
+
+func (a *Api) userAPIKeysCreate(w http.ResponseWriter, r *http.Request) {
+	if user := a.urlUser(w, r); user != nil {
+		a.createAPIKey(w, r, user.Id, user.Role)
+	}
+}
+
+func (a *Api) userAPIKeysList(w http.ResponseWriter, r *http.Request) {
+	if user := a.urlUser(w, r); user != nil {
+		a.listAPIKeys(w, r, user.Id)
+	}
+}
+
+func (a *Api) userAPIKeysDelete(w http.ResponseWriter, r *http.Request) {
+	if user := a.urlUser(w, r); user != nil {
+		a.revokeAPIKey(w, r, user.Id)
+	}
+}
+
+func (a *Api) serviceAccountCreate(w http.ResponseWriter, r *http.Request) {
+	var input ServiceAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to decode json body. Error: %s ", err))
+		return
+	}
+	if !IsLoginValid(input.Login) {
+		a.writeError(w, r, http.StatusBadRequest, loginRequirementsMsg)
+		return
+	}
+
+	if err := a.db.CreateServiceAccount(input.Login); err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"login": input.Login,
+		},
+	})
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/minio/minio-go/v7"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	shareLinkPath       = "/s/"
+	shareSlugLength     = 16
+	sharePasswordHeader = "X-Share-Password"
+)
+
+const (
+	ShareAccessOk          = "ok"
+	ShareAccessExpired     = "expired"
+	ShareAccessExhausted   = "exhausted"
+	ShareAccessBadPassword = "bad_password"
+	ShareAccessUnavailable = "unavailable"
+	ShareAccessRevoked     = "revoked"
+)
+
+func generateShareSlug() (string, error) {
+	b := make([]byte, shareSlugLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Failed to generate share link. Error: %s", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (a *Api) sharingDoc(w http.ResponseWriter, r *http.Request) (*Doc, bool) {
+	doc, ok := a.sharedDoc(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !can(userToken(r), *doc, PermShare) {
+		a.writeError(w, r, http.StatusForbidden, "No share permission for the file")
+		return nil, false
+	}
+	return doc, true
+}
+
+func (a *Api) shareLinksCreate(w http.ResponseWriter, r *http.Request) {
+	var input ShareLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to decode json body. Error: %s ", err))
+		return
+	}
+
+	doc, ok := a.sharingDoc(w, r)
+	if !ok {
+		return
+	}
+
+	now := time.Now().UTC()
+	link := ShareLink{
+		DocId:        doc.Id,
+		CreatedBy:    userToken(r).UserID,
+		MaxDownloads: input.MaxDownloads,
+		Created:      now,
+	}
+
+	if input.ExpiresAt != nil {
+		expiresAt, err := time.Parse(time.RFC3339, *input.ExpiresAt)
+		if err != nil {
+			a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Expires_at must be RFC3339 time. Error: %s", err))
+			return
+		}
+		if !expiresAt.After(now) {
+			a.writeError(w, r, http.StatusBadRequest, "Expires_at must be in the future")
+			return
+		}
+		expiresAt = expiresAt.UTC()
+		link.ExpiresAt = &expiresAt
+	}
+	if input.MaxDownloads != nil && *input.MaxDownloads <= 0 {
+		a.writeError(w, r, http.StatusBadRequest, "Max_downloads must be positive")
+		return
+	}
+
+	if input.Password != "" {
+		hash, err := GeneratePasswordHash(input.Password, a.passwordParams)
+		if err != nil {
+			a.writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		link.PasswordHash = hash
+	}
+
+	slug, err := generateShareSlug()
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	link.Slug = slug
+
+	link.Id, err = a.db.CreateShareLink(link)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	render.JSON(w, r, Response{
+		Data: render.M{
+			"link": NewShareLinkResponse(link),
+		},
+	})
+}
+
+func (a *Api) shareLinksList(w http.ResponseWriter, r *http.Request) {
+	doc, ok := a.sharingDoc(w, r)
+	if !ok {
+		return
+	}
+
+	links, err := a.db.GetShareLinks(doc.Id)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := make([]ShareLinkResponse, 0, len(links))
+	for _, link := range links {
+		resp = append(resp, NewShareLinkResponse(link))
+	}
+
+	render.JSON(w, r, Response{
+		Data: render.M{
+			"links": resp,
+		},
+	})
+}
+
+func (a *Api) shareLinkID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	linkId, err := strconv.ParseInt(chi.URLParam(r, "linkId"), 10, 64)
+	if err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Link id parameter must be integer. Error: %s", err))
+		return 0, false
+	}
+	return linkId, true
+}
+
+func (a *Api) shareLinksDelete(w http.ResponseWriter, r *http.Request) {
+	doc, ok := a.sharingDoc(w, r)
+	if !ok {
+		return
+	}
+	linkId, ok := a.shareLinkID(w, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := a.db.DeleteShareLink(doc.Id, linkId)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !deleted {
+		a.writeError(w, r, http.StatusNotFound, "Share link doesn't exist")
+		return
+	}
+
+	render.JSON(w, r, Response{
+		Response: render.M{
+			strconv.FormatInt(linkId, 10): true,
+		},
+	})
+}
+
+func (a *Api) shareLinkLog(w http.ResponseWriter, r *http.Request) {
+	doc, ok := a.sharingDoc(w, r)
+	if !ok {
+		return
+	}
+	linkId, ok := a.shareLinkID(w, r)
+	if !ok {
+		return
+	}
+
+	links, err := a.db.GetShareLinks(doc.Id)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	found := false
+	for _, link := range links {
+		found = found || link.Id == linkId
+	}
+	if !found {
+		a.writeError(w, r, http.StatusNotFound, "Share link doesn't exist")
+		return
+	}
+
+	entries, err := a.db.GetShareAccessLog(linkId)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := make([]ShareAccessResponse, 0, len(entries))
+	for _, e := range entries {
+		resp = append(resp, ShareAccessResponse{
+			At:        e.At.Format(time.RFC3339),
+			IP:        e.IP,
+			UserAgent: e.UserAgent,
+			Result:    e.Result,
+		})
+	}
+
+	render.JSON(w, r, Response{
+		Data: render.M{
+			"log": resp,
+		},
+	})
+}
+
+// shareLinkOpen streams the shared file without authentication. The password of a protected link
+// is taken from the X-Share-Password header or from the password form field of a POST.
+// Every access to an existing link is logged, successful or not.
+func (a *Api) shareLinkOpen(w http.ResponseWriter, r *http.Request) {
+	// share links have their own limiters, failures here must not lock anyone out of login
+	ip := clientIP(r)
+	if !a.allowAttempt(w, r, a.linkLimiter, ip) {
+		return
+	}
+
+	slug := chi.URLParam(r, "slug")
+	link, err := a.db.GetShareLink(slug)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if link == nil {
+		// unknown slugs count as failures, so links can't be guessed
+		a.linkLimiter.Fail(ip)
+		a.writeError(w, r, http.StatusNotFound, "Link doesn't exist")
+		return
+	}
+
+	access := ShareAccess{
+		At:        time.Now().UTC(),
+		IP:        ip,
+		UserAgent: r.UserAgent(),
+	}
+	logAccess := func(result string) {
+		access.Result = result
+		log.Infof("Share link %d of doc %d accessed from %s: %s", link.Id, link.DocId, ip, result)
+		if err := a.db.LogShareAccess(link.Id, access); err != nil {
+			log.Error(err)
+		}
+	}
+
+	if link.ExpiresAt != nil && !access.At.Before(*link.ExpiresAt) {
+		logAccess(ShareAccessExpired)
+		a.writeError(w, r, http.StatusGone, "Link expired")
+		return
+	}
+	if link.MaxDownloads != nil && link.Downloads >= *link.MaxDownloads {
+		logAccess(ShareAccessExhausted)
+		a.writeError(w, r, http.StatusGone, "Link download limit reached")
+		return
+	}
+
+	doc, ok := a.cache.getDocByID(link.DocId)
+	if !ok || doc.Status != DocStatusClean {
+		logAccess(ShareAccessUnavailable)
+		a.writeError(w, r, http.StatusNotFound, "File doesn't exist")
+		return
+	}
+
+	// the link lives only as long as its creator may share the doc, revoked or expired grants end it
+	creator := UserToken{UserID: link.CreatedBy, GroupIds: a.cache.GetUserGroups(link.CreatedBy)}
+	if !can(&creator, doc, PermShare) {
+		logAccess(ShareAccessRevoked)
+		a.writeError(w, r, http.StatusGone, "Link was revoked")
+		return
+	}
+
+	if link.PasswordHash != "" {
+		// a client is locked out of the link on its own, guessing from many addresses is capped per link
+		limiterKey := slug + "|" + ip
+		if !a.allowAttempt(w, r, a.shareLimiter, limiterKey) || !a.allowAttempt(w, r, a.linkLimiter, slug) {
+			logAccess(ShareAccessBadPassword)
+			return
+		}
+
+		password := r.Header.Get(sharePasswordHeader)
+		if r.Method == http.MethodPost {
+			password = r.PostFormValue("password")
+		}
+		valid, _, err := VerifyPassword(password, link.PasswordHash, a.passwordParams)
+		if err != nil {
+			a.writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !valid {
+			a.shareLimiter.Fail(limiterKey)
+			a.linkLimiter.Fail(slug)
+			a.linkLimiter.Fail(ip)
+			logAccess(ShareAccessBadPassword)
+			a.writeError(w, r, http.StatusUnauthorized, "Invalid link password")
+			return
+		}
+	}
+
+	used, err := a.db.UseShareLink(link.Id)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !used {
+		logAccess(ShareAccessExhausted)
+		a.writeError(w, r, http.StatusGone, "Link download limit reached")
+		return
+	}
+
+	object, err := a.fs.client.GetObject(context.Background(), MinioBucketName, doc.ObjectKey, minio.GetObjectOptions{})
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Failed to get file from minio. Error: %s ", err))
+		return
+	}
+	defer object.Close()
+
+	info, err := object.Stat()
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Failed to get file from minio. Error: %s ", err))
+		return
+	}
+
+	logAccess(ShareAccessOk)
+	w.Header().Set("Content-Type", doc.Mime)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": doc.Filename}))
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := io.Copy(w, object); err != nil {
+		log.Errorf("Failed to stream share link %d. Error: %s", link.Id, err)
+	}
+}
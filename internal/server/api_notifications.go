@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"net/http"
+	"strconv"
+)
+
+func (a *Api) notificationsList(w http.ResponseWriter, r *http.Request) {
+	notifications, err := a.db.GetNotifications(userToken(r).UserID)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := make([]NotificationResponse, 0, len(notifications))
+	for _, n := range notifications {
+		resp = append(resp, NewNotificationResponse(n))
+	}
+
+	render.JSON(w, r, Response{
+		Data: render.M{
+			"notifications": resp,
+		},
+	})
+}
+
+func (a *Api) notificationsDelete(w http.ResponseWriter, r *http.Request) {
+	idParam := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Notification id parameter must be integer. Error: %s", err))
+		return
+	}
+
+	ok, err := a.db.DeleteNotification(userToken(r).UserID, id)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		a.writeError(w, r, http.StatusNotFound, "Notification doesn't exist")
+		return
+	}
+
+	render.JSON(w, r, Response{
+		Response: render.M{
+			idParam: true,
+		},
+	})
+}
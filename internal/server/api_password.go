@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/render"
+	"net/http"
+	"time"
+)
+
+func (a *Api) passwordChange(w http.ResponseWriter, r *http.Request) {
+	usertoken := userToken(r)
+
+	var input ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to decode json body. Error: %s ", err))
+		return
+	}
+
+	if !a.allowAttempt(w, r, a.loginLimiter, usertoken.Login) {
+		return
+	}
+
+	user, err := a.db.GetUser(usertoken.Login)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if user == nil {
+		a.writeError(w, r, http.StatusNotFound, "User doesn't exist")
+		return
+	}
+
+	valid, _, err := VerifyPassword(input.OldPassword, user.Password, a.passwordParams)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !valid {
+		a.loginLimiter.Fail(usertoken.Login)
+		a.writeError(w, r, http.StatusForbidden, "Invalid password")
+		return
+	}
+
+	if !IsPasswordValid(input.Password) {
+		a.writeError(w, r, http.StatusBadRequest, passwordRequirementsMsg)
+		return
+	}
+
+	passwordHash, err := GeneratePasswordHash(input.Password, a.passwordParams)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := a.db.UpdateUserPassword(user.Id, passwordHash); err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if _, err := a.db.DeleteOtherSessions(user.Id, usertoken.SessionID); err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if _, err := a.db.DeleteUserAPIKeys(user.Id); err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.cache.Ch <- SyncTokens
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"login": user.Login,
+		},
+	})
+}
+
+func (a *Api) passwordResetCreate(w http.ResponseWriter, r *http.Request) {
+	user := a.urlUser(w, r)
+	if user == nil {
+		return
+	}
+
+	token, expiresAt, err := a.db.CreatePasswordReset(user.Id, passwordResetTTL)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"login":       user.Login,
+			"reset_token": token,
+			"expires_at":  expiresAt.Format(time.RFC3339),
+		},
+	})
+}
+
+func (a *Api) passwordReset(w http.ResponseWriter, r *http.Request) {
+	var input ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to decode json body. Error: %s ", err))
+		return
+	}
+
+	ip := clientIP(r)
+	if !a.allowAttempt(w, r, a.ipLimiter, ip) {
+		return
+	}
+
+	if !IsPasswordValid(input.Password) {
+		a.writeError(w, r, http.StatusBadRequest, passwordRequirementsMsg)
+		return
+	}
+
+	passwordHash, err := GeneratePasswordHash(input.Password, a.passwordParams)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ok, err := a.db.ResetPassword(HashToken(input.ResetToken), passwordHash)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		a.ipLimiter.Fail(ip)
+		a.writeError(w, r, http.StatusForbidden, "Reset token is invalid or expired")
+		return
+	}
+
+	a.cache.Ch <- SyncTokens
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"reset": true,
+		},
+	})
+}
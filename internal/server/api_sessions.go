@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func (a *Api) sessionsList(w http.ResponseWriter, r *http.Request) {
+	usertoken := userToken(r)
+
+	sessions, err := a.db.GetSessions(usertoken.UserID)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := make([]SessionResponse, 0, len(sessions))
+	for _, s := range sessions {
+		resp = append(resp, SessionResponse{
+			Id:         s.Id,
+			Device:     s.Device,
+			UserAgent:  s.UserAgent,
+			IP:         s.IP,
+			IssuedAt:   s.IssuedAt.Format(time.RFC3339),
+			ExpiresAt:  s.ExpiresAt.Format(time.RFC3339),
+			LastUsedAt: s.LastUsedAt.Format(time.RFC3339),
+			Current:    s.Id == usertoken.SessionID,
+		})
+	}
+
+	render.JSON(w, r, render.M{
+		"data": render.M{
+			"sessions": resp,
+		},
+	})
+}
+
+func (a *Api) sessionsDelete(w http.ResponseWriter, r *http.Request) {
+	usertoken := userToken(r)
+
+	sessionIdParam := chi.URLParam(r, "id")
+	sessionId, err := strconv.ParseInt(sessionIdParam, 10, 64)
+	if err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Session id parameter must be integer. Error: %s", err))
+		return
+	}
+
+	ok, err := a.db.DeleteSession(usertoken.UserID, sessionId)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		a.writeError(w, r, http.StatusNotFound, "Session doesn't exist")
+		return
+	}
+
+	a.cache.Ch <- SyncTokens
+	render.JSON(w, r, Response{
+		Response: render.M{
+			sessionIdParam: true,
+		},
+	})
+}
+
+func (a *Api) sessionsDeleteOthers(w http.ResponseWriter, r *http.Request) {
+	usertoken := userToken(r)
+	// JWT callers have no session of their own, so "others" would be every session
+	if usertoken.SessionID == 0 {
+		a.writeError(w, r, http.StatusForbidden, "Only a session can revoke other sessions, use DELETE /api/auth to revoke all")
+		return
+	}
+
+	n, err := a.db.DeleteOtherSessions(usertoken.UserID, usertoken.SessionID)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.cache.Ch <- SyncTokens
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"revoked": n,
+		},
+	})
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func (a *Api) checkGrantees(w http.ResponseWriter, r *http.Request, grants []GrantSpec) bool {
+	if len(grants) == 0 {
+		return true
+	}
+	unresolved, err := a.db.UnresolvedGrantees(grants)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	if len(unresolved) > 0 {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Unknown grantees: %s", strings.Join(unresolved, ", ")))
+		return false
+	}
+	return true
+}
+
+func (a *Api) sharedDoc(w http.ResponseWriter, r *http.Request) (*Doc, bool) {
+	docIdParam := chi.URLParam(r, "id")
+	docId, err := strconv.Atoi(docIdParam)
+	if err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Doc id parameter must be integer. Error: %s", err))
+		return nil, false
+	}
+
+	doc, ok := a.cache.getDocByID(int64(docId))
+	if !ok || doc.Status != DocStatusClean || !canRead(userToken(r), doc) {
+		a.writeError(w, r, http.StatusNotFound, "File doesn't exist")
+		return nil, false
+	}
+	return &doc, true
+}
+
+func (a *Api) writeDocGrants(w http.ResponseWriter, r *http.Request, doc *Doc, public bool, unresolved []string) {
+	grants, err := a.db.GetDocGrants(doc.Id)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	data := render.M{
+		"id":     doc.Id,
+		"public": public,
+		"grants": NewGrantResponses(grants),
+	}
+	if unresolved != nil {
+		data["unresolved"] = unresolved
+	}
+	render.JSON(w, r, Response{
+		Data: data,
+	})
+}
+
+func (a *Api) docGrantsGet(w http.ResponseWriter, r *http.Request) {
+	doc, ok := a.sharedDoc(w, r)
+	if !ok {
+		return
+	}
+	a.writeDocGrants(w, r, doc, doc.Public, nil)
+}
+
+// docGrantsPatch lets holders of the share permission change grants. Those who aren't owners
+// can only hand out and revoke permissions they have themselves, their grants expire no later
+// than their own share permission, and only owners and admins can make the doc public.
+func (a *Api) docGrantsPatch(w http.ResponseWriter, r *http.Request) {
+	var input DocGrantsPatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to decode json body. Error: %s ", err))
+		return
+	}
+
+	doc, ok := a.sharedDoc(w, r)
+	if !ok {
+		return
+	}
+
+	usertoken := userToken(r)
+	perm := docPermissions(usertoken, *doc)
+	if !perm.Has(PermShare) {
+		a.writeError(w, r, http.StatusForbidden, "No share permission for the file")
+		return
+	}
+	if err := checkGrantChanges(perm, doc, input.Add, input.Remove); err != nil {
+		a.writeError(w, r, http.StatusForbidden, err.Error())
+		return
+	}
+	if input.Public != nil && *input.Public != doc.Public && doc.OwnerId != usertoken.UserID && !usertoken.HasScope(ScopeAdmin) {
+		a.writeError(w, r, http.StatusForbidden, "Only the owner can change public access")
+		return
+	}
+	// otherwise grants to a group the caller owns would outlive the caller's own access
+	capGrantExpiry(input.Add, permissionExpiry(usertoken, *doc, PermShare))
+
+	unresolved, err := a.db.UpdateDocSharing(doc.Id, doc.OwnerId, input.Public, false, input.Remove, input.Add)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.cache.Ch <- SyncDocs
+	public := doc.Public
+	if input.Public != nil {
+		public = *input.Public
+	}
+	a.writeDocGrants(w, r, doc, public, unresolved)
+}
+
+func (a *Api) docGrantsPut(w http.ResponseWriter, r *http.Request) {
+	var input DocGrantsPutRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to decode json body. Error: %s ", err))
+		return
+	}
+
+	doc, ok := a.sharedDoc(w, r)
+	if !ok {
+		return
+	}
+	if doc.OwnerId != userToken(r).UserID {
+		a.writeError(w, r, http.StatusForbidden, "Only the owner can replace all grants")
+		return
+	}
+
+	unresolved, err := a.db.UpdateDocSharing(doc.Id, doc.OwnerId, input.Public, true, nil, input.Grants)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.cache.Ch <- SyncDocs
+	public := doc.Public
+	if input.Public != nil {
+		public = *input.Public
+	}
+	a.writeDocGrants(w, r, doc, public, unresolved)
+}
+
+// checkGrantChanges allows changes only within the permissions of the caller: a new grant can't have more
+// than the caller has, and replacing or revoking an existing grant can't take away what the caller doesn't have.
+func checkGrantChanges(perm Permission, doc *Doc, add []GrantSpec, remove []string) error {
+	for _, g := range add {
+		if extra := g.Permissions &^ perm; extra != 0 {
+			return fmt.Errorf("Can't grant %s to %s, you don't have these permissions", strings.Join(extra.Names(), ","), g.Name)
+		}
+		if lost := grantPermissions(doc, g.Name) &^ g.Permissions &^ perm; lost != 0 {
+			return fmt.Errorf("Can't revoke %s from %s, you don't have these permissions", strings.Join(lost.Names(), ","), g.Name)
+		}
+	}
+	for _, name := range remove {
+		if lost := grantPermissions(doc, name) &^ perm; lost != 0 {
+			return fmt.Errorf("Can't revoke %s from %s, you don't have these permissions", strings.Join(lost.Names(), ","), name)
+		}
+	}
+	return nil
+}
+
+func grantPermissions(doc *Doc, name string) Permission {
+	for _, g := range doc.Grants {
+		if g.Name == name {
+			return g.Permissions
+		}
+	}
+	return 0
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/render"
+	"net/http"
+	"time"
+)
+
+func (a *Api) checkSecondFactor(user *User, input TOTPRequest) (bool, error) {
+	if input.OTP != "" {
+		step, ok := VerifyTOTP(user.TotpSecret, input.OTP, time.Now())
+		if !ok {
+			return false, nil
+		}
+		return a.db.UseTOTPStep(user.Id, step)
+	}
+	if input.RecoveryCode != "" {
+		return a.db.UseRecoveryCode(user.Id, HashRecoveryCode(input.RecoveryCode))
+	}
+	return false, nil
+}
+
+// currentUser loads the caller from db, the cached token doesn't hold 2FA secrets.
+func (a *Api) currentUser(w http.ResponseWriter, r *http.Request) *User {
+	user, err := a.db.GetUser(userToken(r).Login)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return nil
+	}
+	if user == nil {
+		a.writeError(w, r, http.StatusNotFound, "User doesn't exist")
+		return nil
+	}
+	return user
+}
+
+// totpEnroll generates a new secret. 2FA starts working only after totpConfirm.
+// The password is asked again, so a stolen token alone can't bind the account to someone else's device.
+func (a *Api) totpEnroll(w http.ResponseWriter, r *http.Request) {
+	var input TOTPEnrollRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to decode json body. Error: %s ", err))
+		return
+	}
+
+	user := a.currentUser(w, r)
+	if user == nil {
+		return
+	}
+	if user.TotpEnabled {
+		a.writeError(w, r, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	if !a.allowAttempt(w, r, a.loginLimiter, user.Login) {
+		return
+	}
+	valid, _, err := VerifyPassword(input.Password, user.Password, a.passwordParams)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !valid {
+		a.loginLimiter.Fail(user.Login)
+		a.writeError(w, r, http.StatusForbidden, "Invalid password")
+		return
+	}
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := a.db.SetTOTPSecret(user.Id, secret); err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"secret": secret,
+			"uri":    TOTPProvisioningURI(user.Login, secret),
+		},
+	})
+}
+
+func (a *Api) totpConfirm(w http.ResponseWriter, r *http.Request) {
+	var input TOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to decode json body. Error: %s ", err))
+		return
+	}
+
+	user := a.currentUser(w, r)
+	if user == nil {
+		return
+	}
+	if user.TotpEnabled {
+		a.writeError(w, r, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	if user.TotpSecret == "" {
+		a.writeError(w, r, http.StatusBadRequest, "Two-factor enrollment is not started")
+		return
+	}
+
+	if !a.allowAttempt(w, r, a.loginLimiter, user.Login) {
+		return
+	}
+
+	step, ok := VerifyTOTP(user.TotpSecret, input.OTP, time.Now())
+	if !ok {
+		a.loginLimiter.Fail(user.Login)
+		a.writeError(w, r, http.StatusForbidden, "Invalid two-factor code")
+		return
+	}
+
+	codes, err := GenerateRecoveryCodes()
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+
+	if err := a.db.EnableTOTP(user.Id, step, hashes); err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.cache.Ch <- SyncTokens
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"enabled":        true,
+			"recovery_codes": codes,
+		},
+	})
+}
+
+func (a *Api) totpDisable(w http.ResponseWriter, r *http.Request) {
+	var input TOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to decode json body. Error: %s ", err))
+		return
+	}
+
+	user := a.currentUser(w, r)
+	if user == nil {
+		return
+	}
+	if !user.TotpEnabled {
+		a.writeError(w, r, http.StatusBadRequest, "Two-factor authentication is not enabled")
+		return
+	}
+	if user.TotpRequired {
+		a.writeError(w, r, http.StatusForbidden, "Two-factor authentication is required for this user")
+		return
+	}
+
+	if !a.allowAttempt(w, r, a.loginLimiter, user.Login) {
+		return
+	}
+
+	ok, err := a.checkSecondFactor(user, input)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		a.loginLimiter.Fail(user.Login)
+		a.writeError(w, r, http.StatusForbidden, "Invalid two-factor code")
+		return
+	}
+
+	if err := a.db.DisableTOTP(user.Id); err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.cache.Ch <- SyncTokens
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"enabled": false,
+		},
+	})
+}
+
+func (a *Api) totpRequire(w http.ResponseWriter, r *http.Request) {
+	var input TOTPRequiredRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to decode json body. Error: %s ", err))
+		return
+	}
+
+	user := a.urlUser(w, r)
+	if user == nil {
+		return
+	}
+	if input.Required && user.ServiceAccount {
+		a.writeError(w, r, http.StatusBadRequest, "Service accounts can't enroll two-factor authentication")
+		return
+	}
+
+	if err := a.db.SetTOTPRequired(user.Id, input.Required); err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.cache.Ch <- SyncTokens
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"login":    user.Login,
+			"required": input.Required,
+		},
+	})
+}
+
+func (a *Api) totpReset(w http.ResponseWriter, r *http.Request) {
+	user := a.urlUser(w, r)
+	if user == nil {
+		return
+	}
+
+	if err := a.db.DisableTOTP(user.Id); err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.cache.Ch <- SyncTokens
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"login":   user.Login,
+			"enabled": false,
+		},
+	})
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-chi/render"
+	"github.com/minio/minio-go/v7"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+)
+
+func (a *Api) usersList(w http.ResponseWriter, r *http.Request) {
+	users, err := a.db.GetUsers()
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := make([]UserResponse, 0, len(users))
+	for _, user := range users {
+		resp = append(resp, NewUserResponse(user))
+	}
+
+	render.JSON(w, r, Response{
+		Data: render.M{
+			"users": resp,
+		},
+	})
+}
+
+func (a *Api) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	user := a.urlUser(w, r)
+	if user == nil {
+		return
+	}
+
+	ok, err := a.db.SetUserDisabled(user.Id, disabled)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		a.writeError(w, r, http.StatusConflict, "The last active admin can't be disabled")
+		return
+	}
+
+	a.cache.Ch <- SyncTokens
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"login":    user.Login,
+			"disabled": disabled,
+		},
+	})
+}
+
+func (a *Api) userDisable(w http.ResponseWriter, r *http.Request) {
+	a.setUserDisabled(w, r, true)
+}
+
+func (a *Api) userEnable(w http.ResponseWriter, r *http.Request) {
+	a.setUserDisabled(w, r, false)
+}
+
+func (a *Api) userDelete(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var purge bool
+	var err error
+	if purgeParam := query.Get("purge"); purgeParam != "" {
+		purge, err = strconv.ParseBool(purgeParam)
+		if err != nil {
+			a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Purge parameter must be boolean. Error: %s", err))
+			return
+		}
+	}
+	transferTo := query.Get("transfer_to")
+	if purge && transferTo != "" {
+		a.writeError(w, r, http.StatusBadRequest, "Use either transfer_to or purge")
+		return
+	}
+
+	user := a.urlUser(w, r)
+	if user == nil {
+		return
+	}
+
+	var newOwnerId int64
+	if transferTo != "" {
+		newOwner, err := a.db.GetUser(transferTo)
+		if err != nil {
+			a.writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if newOwner == nil {
+			a.writeError(w, r, http.StatusBadRequest, fmt.Sprintf("User %s not found", transferTo))
+			return
+		}
+		if newOwner.Id == user.Id {
+			a.writeError(w, r, http.StatusBadRequest, "Documents can't be transferred to the deleted user")
+			return
+		}
+		if newOwner.Disabled || newOwner.ServiceAccount {
+			a.writeError(w, r, http.StatusBadRequest, "Documents can be transferred only to an active user who can log in")
+			return
+		}
+		newOwnerId = newOwner.Id
+	} else if !purge {
+		n, err := a.db.CountUserDocs(user.Id)
+		if err != nil {
+			a.writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n > 0 {
+			a.writeError(w, r, http.StatusConflict, fmt.Sprintf("User owns %d documents, pass transfer_to=<login> or purge=true", n))
+			return
+		}
+	}
+
+	deletion, err := a.db.DeleteUser(user.Id, newOwnerId)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if deletion == nil {
+		a.writeError(w, r, http.StatusConflict, "The last admin can't be deleted")
+		return
+	}
+
+	for _, doc := range deletion.Purged {
+		err := a.fs.client.RemoveObject(context.Background(), MinioBucketName, doc.ObjectKey, minio.RemoveObjectOptions{})
+		if err != nil {
+			log.Error(err)
+		}
+		if err := a.fs.RemoveThumbnails(context.Background(), doc.Id); err != nil {
+			log.Error(err)
+		}
+	}
+
+	a.cache.Ch <- SyncTokens
+	a.cache.Ch <- SyncDocs
+	render.JSON(w, r, Response{
+		Response: render.M{
+			"login":       user.Login,
+			"transferred": deletion.Transferred,
+			"purged":      len(deletion.Purged),
+		},
+	})
+}
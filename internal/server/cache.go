@@ -19,6 +19,8 @@ type Cache struct {
 	docsMx        sync.RWMutex
 	docs          map[string]Doc
 	tokens        map[string]UserToken
+	apiKeys       map[string]APIKey
+	groups        map[int64][]int64
 	tokensMx      sync.RWMutex
 	Ch            chan SyncType
 }
@@ -61,35 +63,69 @@ func (c *Cache) tokensSync() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	apiKeys, err := c.db.GetAPIKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	groups, err := c.db.GetGroupMemberships()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	c.tokens = tokens
+	c.apiKeys = apiKeys
+	c.groups = groups
 }
 
-func (c *Cache) GetUserToken(token string) (UserToken, bool) {
+func (c *Cache) GetUserGroups(userId int64) []int64 {
 	c.tokensMx.RLock()
 	defer c.tokensMx.RUnlock()
 
-	userToken, ok := c.tokens[token]
-	return userToken, ok
+	return c.groups[userId]
 }
 
-func (c *Cache) GetUserTokens() map[string]UserToken {
+func (c *Cache) GetUserToken(tokenHash string) (UserToken, bool) {
 	c.tokensMx.RLock()
 	defer c.tokensMx.RUnlock()
 
-	return c.tokens
+	userToken, ok := c.tokens[tokenHash]
+	return userToken, ok
+}
+
+func (c *Cache) TouchUserToken(tokenHash string, at time.Time) {
+	c.tokensMx.Lock()
+	defer c.tokensMx.Unlock()
+
+	if ut, ok := c.tokens[tokenHash]; ok {
+		ut.LastUsedAt = at
+		c.tokens[tokenHash] = ut
+	}
 }
 
-func (c *Cache) GetUserTokenByUserID(userId int64) (UserToken, bool) {
+func (c *Cache) GetAPIKey(keyHash string) (APIKey, bool) {
 	c.tokensMx.RLock()
 	defer c.tokensMx.RUnlock()
 
-	for _, ut := range c.tokens {
-		if ut.UserID == userId {
-			return ut, true
-		}
+	key, ok := c.apiKeys[keyHash]
+	return key, ok
+}
+
+func (c *Cache) TouchAPIKey(keyHash string, at time.Time) {
+	c.tokensMx.Lock()
+	defer c.tokensMx.Unlock()
+
+	if key, ok := c.apiKeys[keyHash]; ok {
+		key.LastUsedAt = at
+		c.apiKeys[keyHash] = key
 	}
-	return UserToken{}, false
+}
+
+func (c *Cache) GetUserTokens() map[string]UserToken {
+	c.tokensMx.RLock()
+	defer c.tokensMx.RUnlock()
+
+	return c.tokens
 }
 
 func (c *Cache) docsSync() {
@@ -132,3 +168,21 @@ func (c *Cache) getDocs() map[string]Doc {
 
 	return c.docs
 }
+
+func (c *Cache) getDocsByIDs(ids []int64) []Doc {
+	c.docsMx.RLock()
+	defer c.docsMx.RUnlock()
+
+	byId := make(map[int64]Doc, len(c.docs))
+	for _, d := range c.docs {
+		byId[d.Id] = d
+	}
+
+	docs := make([]Doc, 0, len(ids))
+	for _, id := range ids {
+		if d, ok := byId[id]; ok {
+			docs = append(docs, d)
+		}
+	}
+	return docs
+}
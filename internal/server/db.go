@@ -1,45 +1,261 @@
 package server
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
+	"strings"
 	"time"
 )
 
+const pqUniqueViolation = "23505"
+
+var errDocExists = errors.New("Doc with the same name exists")
+
 type User struct {
-	Id       int64  `db:"id"`
-	Login    string `db:"login"`
-	Password string `db:"password"`
+	Id           int64  `db:"id"`
+	Login        string `db:"login"`
+	Password     string `db:"password"`
+	TotpSecret   string `db:"totp_secret"`
+	TotpEnabled  bool   `db:"totp_enabled"`
+	TotpRequired bool   `db:"totp_required"`
+
+	// service accounts can't log in with a password, they work only through API keys
+	ServiceAccount bool `db:"service_account"`
+
+	Role     string `db:"role"`
+	Disabled bool   `db:"disabled"`
+
+	// IdpSubject binds the user to a JWT subject, only such users can log in with a JWT
+	IdpSubject *string `db:"idp_subject"`
+}
+
+type UserDeletion struct {
+	Transferred int64
+	Purged      []Doc
 }
 
 type Doc struct {
-	Id       int64     `db:"id"`
-	Filename string    `db:"filename"`
-	Public   bool      `db:"public"`
-	Mime     string    `db:"mime"`
-	OwnerId  int64     `db:"owner_id"`
-	Created  time.Time `db:"created"`
-	GrantIds []int64
-	Grant    []string
+	Id        int64     `db:"id"`
+	Filename  string    `db:"filename"`
+	Public    bool      `db:"public"`
+	Mime      string    `db:"mime"`
+	OwnerId   int64     `db:"owner_id"`
+	Created   time.Time `db:"created"`
+	Status    string    `db:"status"`
+	Signature string    `db:"signature"`
+	// minio key of the content, it doesn't change when the doc is renamed
+	ObjectKey string `db:"object_key"`
+	// incremented on every change, exposed as ETag
+	Version int64 `db:"version"`
+	// size and sha256 of the content, modified changes when the content is replaced
+	Size     int64     `db:"size"`
+	Hash     string    `db:"hash"`
+	Modified time.Time `db:"modified"`
+	// grants by user id and by group id, group members are resolved at access time
+	UserGrants  map[int64]DocGrant
+	GroupGrants map[int64]DocGrant
+	// grantee logins and "@group" names for responses
+	Grant  []string
+	Grants []DocGrant
+}
+
+type DocGrant struct {
+	Name        string     `db:"name"`
+	Permissions Permission `db:"permissions"`
+	ExpiresAt   *time.Time `db:"expires_at"`
+}
+
+func (g DocGrant) Active(now time.Time) bool {
+	return g.ExpiresAt == nil || now.Before(*g.ExpiresAt)
+}
+
+type ExpiredGrant struct {
+	DocId    int64  `db:"doc_id"`
+	Filename string `db:"filename"`
+	OwnerId  int64  `db:"owner_id"`
+	Name     string `db:"name"`
+}
+
+type Notification struct {
+	Id      int64     `db:"id"`
+	UserId  int64     `db:"user_id"`
+	Message string    `db:"message"`
+	Created time.Time `db:"created"`
+}
+
+type NewDoc struct {
+	Filename  string
+	Public    bool
+	Mime      string
+	OwnerId   int64
+	Grant     []GrantSpec
+	Status    string
+	Signature string
+	ObjectKey string
+	Size      int64
+	Hash      string
+	// attached json, nil if there is none
+	Json *string
+}
+
+type DocContent struct {
+	ObjectKey string
+	Mime      string
+	Size      int64
+	Hash      string
+	Status    string
+}
+
+// DocMetaUpdate holds changes of a doc, nil fields stay as they are.
+type DocMetaUpdate struct {
+	Filename *string
+	Mime     *string
+	// Json is written only if SetJson is true, nil removes the attached json
+	SetJson bool
+	Json    *string
 }
 
 type UsersDocsGrant struct {
-	UserId int64 `db:"user_id"`
-	DocId  int64 `db:"doc_id"`
+	UserId      int64      `db:"user_id"`
+	DocId       int64      `db:"doc_id"`
+	Login       string     `db:"login"`
+	Permissions Permission `db:"permissions"`
+	ExpiresAt   *time.Time `db:"expires_at"`
+}
+
+type DocsGroupGrant struct {
+	GroupId     int64      `db:"group_id"`
+	DocId       int64      `db:"doc_id"`
+	Name        string     `db:"name"`
+	Permissions Permission `db:"permissions"`
+	ExpiresAt   *time.Time `db:"expires_at"`
+}
+
+type Group struct {
+	Id         int64     `db:"id"`
+	Name       string    `db:"name"`
+	OwnerId    int64     `db:"owner_id"`
+	OwnerLogin string    `db:"owner_login"`
+	Created    time.Time `db:"created"`
+	Members    []string
+}
+
+type GroupMember struct {
+	GroupId int64  `db:"group_id"`
+	UserId  int64  `db:"user_id"`
+	Login   string `db:"login"`
+}
+
+type ShareLink struct {
+	Id           int64      `db:"id"`
+	DocId        int64      `db:"doc_id"`
+	Slug         string     `db:"slug"`
+	CreatedBy    int64      `db:"created_by"`
+	PasswordHash string     `db:"password_hash"`
+	ExpiresAt    *time.Time `db:"expires_at"`
+	MaxDownloads *int64     `db:"max_downloads"`
+	Downloads    int64      `db:"downloads"`
+	Created      time.Time  `db:"created"`
+}
+
+type ShareAccess struct {
+	At        time.Time `db:"at"`
+	IP        string    `db:"ip"`
+	UserAgent string    `db:"user_agent"`
+	Result    string    `db:"result"`
 }
 
 type Token struct {
-	UserId int64  `db:"user_id"`
-	Token  string `db:"token"`
+	UserId    int64  `db:"user_id"`
+	TokenHash string `db:"token_hash"`
 }
 
 type UserToken struct {
-	UserID   int64  `db:"id"`
-	Login    string `db:"login"`
-	Password string `db:"password"`
-	Token    string `db:"token"`
+	UserID     int64     `db:"id"`
+	SessionID  int64     `db:"session_id"`
+	Login      string    `db:"login"`
+	Password   string    `db:"password"`
+	TokenHash  string    `db:"token_hash"`
+	IssuedAt   time.Time `db:"issued_at"`
+	ExpiresAt  time.Time `db:"expires_at"`
+	LastUsedAt time.Time `db:"last_used_at"`
+
+	TotpEnabled  bool `db:"totp_enabled"`
+	TotpRequired bool `db:"totp_required"`
+
+	Role     string `db:"role"`
+	Disabled bool   `db:"disabled"`
+	GroupIds []int64
+
+	// set only for API keys, sessions have every scope of the user
+	APIKeyID  int64    `db:"-"`
+	Scopes    []string `db:"-"`
+	DocPrefix string   `db:"-"`
+}
+
+type APIKey struct {
+	Id         int64          `db:"id"`
+	UserId     int64          `db:"user_id"`
+	Login      string         `db:"login"`
+	Name       string         `db:"name"`
+	Prefix     string         `db:"prefix"`
+	KeyHash    string         `db:"key_hash"`
+	Scopes     pq.StringArray `db:"scopes"`
+	DocPrefix  string         `db:"doc_prefix"`
+	CreatedAt  time.Time      `db:"created_at"`
+	LastUsedAt time.Time      `db:"last_used_at"`
+	Role       string         `db:"role"`
+	Disabled   bool           `db:"disabled"`
+
+	TotpEnabled  bool `db:"totp_enabled"`
+	TotpRequired bool `db:"totp_required"`
+}
+
+type Session struct {
+	Id         int64     `db:"id"`
+	TokenHash  string    `db:"token_hash"`
+	Device     string    `db:"device"`
+	UserAgent  string    `db:"user_agent"`
+	IP         string    `db:"ip"`
+	IssuedAt   time.Time `db:"issued_at"`
+	ExpiresAt  time.Time `db:"expires_at"`
+	LastUsedAt time.Time `db:"last_used_at"`
+}
+
+type SessionInfo struct {
+	Device    string
+	UserAgent string
+	IP        string
+}
+
+type IssuedToken struct {
+	Token            string
+	RefreshToken     string
+	ExpiresAt        time.Time
+	RefreshExpiresAt time.Time
+}
+
+func newIssuedToken(ttl time.Duration, refreshTTL time.Duration) (*IssuedToken, error) {
+	token, err := GenerateSecureToken()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate token. Error: %s", err)
+	}
+	refresh, err := GenerateSecureToken()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate refresh token. Error: %s", err)
+	}
+
+	now := time.Now().UTC()
+	return &IssuedToken{
+		Token:            token,
+		RefreshToken:     refresh,
+		ExpiresAt:        now.Add(ttl),
+		RefreshExpiresAt: now.Add(refreshTTL),
+	}, nil
 }
 
 type DB struct {
@@ -62,13 +278,13 @@ func (d *DB) Close() {
 	}
 }
 
-func (d *DB) CreateNewUser(login string, passwordHash string) error {
+func (d *DB) CreateNewUser(login string, passwordHash string, role string) error {
 	tx, err := d.db.Beginx()
 	if err != nil {
 		return fmt.Errorf("Failed to create user transaction. Error: %s ", err)
 	}
 
-	_, err = tx.Exec("INSERT INTO public.users (login, password) VALUES ($1, $2)", login, passwordHash)
+	_, err = tx.Exec("INSERT INTO public.users (login, password, role) VALUES ($1, $2, $3)", login, passwordHash, role)
 	if err != nil {
 		return fmt.Errorf("Failed to create new user. Error: %s ", err)
 	}
@@ -82,7 +298,8 @@ func (d *DB) CreateNewUser(login string, passwordHash string) error {
 
 func (d *DB) GetUser(login string) (*User, error) {
 	var users []User
-	err := d.db.Select(&users, "SELECT id, login, password FROM public.users WHERE login = $1 LIMIT 1", login)
+	err := d.db.Select(&users, `SELECT id, login, password, totp_secret, totp_enabled, totp_required, service_account, role, disabled, idp_subject
+		FROM public.users WHERE login = $1 LIMIT 1`, login)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to get user from db. Error: %s ", err.Error())
 	}
@@ -92,170 +309,1328 @@ func (d *DB) GetUser(login string) (*User, error) {
 	return &users[0], nil
 }
 
-func (d *DB) GetUserByIds(ids []int64) ([]User, error) {
+func (d *DB) GetUserBySubject(subject string) (*User, error) {
 	var users []User
-	err := d.db.Select(&users, "SELECT id, login, password FROM public.users WHERE id = ANY($1)", pq.Array(ids))
+	err := d.db.Select(&users, `SELECT id, login, password, totp_secret, totp_enabled, totp_required, service_account, role, disabled, idp_subject
+		FROM public.users WHERE idp_subject = $1 LIMIT 1`, subject)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get users from db. Error: %s ", err.Error())
+		return nil, fmt.Errorf("Failed to get user by subject from db. Error: %s ", err.Error())
 	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+	return &users[0], nil
+}
 
-	return users, nil
+func (d *DB) CreateIdpUser(login string, subject string) error {
+	_, err := d.db.Exec("INSERT INTO public.users (login, password, role, idp_subject) VALUES ($1, '', $2, $3)", login, RoleUser, subject)
+	if err != nil {
+		return fmt.Errorf("Failed to create idp user. Error: %s ", err)
+	}
+	return nil
 }
 
-func (d *DB) GetTokens() (map[string]UserToken, error) {
-	var userTokens []UserToken
-	err := d.db.Select(&userTokens, "SELECT u.id, u.login, u.password, t.token FROM public.users u JOIN public.tokens t ON (u.id = t.user_id)")
+func (d *DB) SetUserIdpSubject(userId int64, subject *string) error {
+	_, err := d.db.Exec("UPDATE public.users SET idp_subject = $2 WHERE id = $1", userId, subject)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get tokens. Error: %s ", err)
+		return fmt.Errorf("Failed to set user idp subject. Error: %s ", err)
 	}
+	return nil
+}
 
-	userTokensMap := make(map[string]UserToken)
-	for _, ut := range userTokens {
-		userTokensMap[ut.Token] = ut
+// lockUsers serializes transactions which check the admins before changing users. Under READ COMMITTED
+// two of them would both see the old admins and could leave none or create two first admins.
+func lockUsers(tx *sqlx.Tx) error {
+	_, err := tx.Exec("LOCK TABLE public.users IN SHARE ROW EXCLUSIVE MODE")
+	if err != nil {
+		return fmt.Errorf("Failed to lock users. Error: %s ", err)
 	}
+	return nil
+}
 
-	return userTokensMap, nil
+func (d *DB) CreateFirstAdmin(login string, passwordHash string) (bool, error) {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return false, fmt.Errorf("Failed to create admin transaction. Error: %s ", err)
+	}
+	defer tx.Rollback()
+
+	if err := lockUsers(tx); err != nil {
+		return false, err
+	}
+
+	res, err := tx.Exec(`INSERT INTO public.users (login, password, role)
+		SELECT $1, $2, $3 WHERE NOT EXISTS (SELECT 1 FROM public.users WHERE role = $3)`, login, passwordHash, RoleAdmin)
+	if err != nil {
+		return false, fmt.Errorf("Failed to create admin. Error: %s ", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Failed to create admin. Error: %s ", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("Failed to commit admin. Error: %s ", err)
+	}
+	return n > 0, nil
 }
 
-func (d *DB) CreateToken(userId int64) (*Token, error) {
-	token, err := GenerateSecureToken()
+func (d *DB) HasAdmin() (bool, error) {
+	var exists bool
+	err := d.db.Get(&exists, "SELECT EXISTS (SELECT 1 FROM public.users WHERE role = $1)", RoleAdmin)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to generate token. Error: %s", err)
+		return false, fmt.Errorf("Failed to check admins. Error: %s ", err)
 	}
+	return exists, nil
+}
 
+func (d *DB) SetUserRole(userId int64, role string) (bool, error) {
 	tx, err := d.db.Beginx()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create token transaction. Error: %s ", err)
+		return false, fmt.Errorf("Failed to create user transaction. Error: %s ", err)
+	}
+	defer tx.Rollback()
+
+	if err := lockUsers(tx); err != nil {
+		return false, err
 	}
 
-	_, err = tx.Exec("INSERT INTO public.tokens (user_id, token) VALUES ($1, $2)", userId, token)
+	res, err := tx.Exec(`UPDATE public.users SET role = $2 WHERE id = $1
+		AND ($2 = $3 OR role <> $3 OR (SELECT count(*) FROM public.users WHERE role = $3) > 1)`, userId, role, RoleAdmin)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create new token. Error: %s ", err)
+		return false, fmt.Errorf("Failed to set user role. Error: %s ", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Failed to set user role. Error: %s ", err)
 	}
 
 	if err := tx.Commit(); err != nil {
-		return nil, fmt.Errorf("Failed to commit created token. Error: %s ", err)
+		return false, fmt.Errorf("Failed to commit user role. Error: %s ", err)
 	}
+	return n > 0, nil
+}
 
-	return &Token{
-		UserId: userId,
-		Token:  token,
-	}, nil
+func (d *DB) GetUsers() ([]User, error) {
+	var users []User
+	err := d.db.Select(&users, `SELECT id, login, totp_enabled, totp_required, service_account, role, disabled
+		FROM public.users ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get users from db. Error: %s ", err)
+	}
+	return users, nil
 }
 
-func (d *DB) GetToken(userId int64) (*Token, error) {
-	var tokens []Token
+func (d *DB) CountUserDocs(userId int64) (int64, error) {
+	var n int64
+	err := d.db.Get(&n, "SELECT count(*) FROM public.docs WHERE owner_id = $1", userId)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to count user docs. Error: %s ", err)
+	}
+	return n, nil
+}
 
-	err := d.db.Select(tokens, "SELECT user_id, token FROM public.tokens WHERE user_id = $1 LIMIT 1", userId)
+func (d *DB) SetUserDisabled(userId int64, disabled bool) (bool, error) {
+	tx, err := d.db.Beginx()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get token by user id. Error: %s ", err)
+		return false, fmt.Errorf("Failed to create user transaction. Error: %s ", err)
 	}
+	defer tx.Rollback()
 
-	if len(tokens) == 0 {
-		return nil, nil
+	if err := lockUsers(tx); err != nil {
+		return false, err
 	}
 
-	return &tokens[0], nil
+	res, err := tx.Exec(`UPDATE public.users SET disabled = $2 WHERE id = $1
+		AND (NOT $2 OR role <> $3 OR (SELECT count(*) FROM public.users WHERE role = $3 AND NOT disabled) > 1)`, userId, disabled, RoleAdmin)
+	if err != nil {
+		return false, fmt.Errorf("Failed to update user. Error: %s ", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Failed to update user. Error: %s ", err)
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	if disabled {
+		_, err = tx.Exec("DELETE FROM public.tokens WHERE user_id = $1", userId)
+		if err != nil {
+			return false, fmt.Errorf("Failed to delete user tokens. Error: %s ", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("Failed to commit user update. Error: %s ", err)
+	}
+	return true, nil
 }
 
-func (d *DB) DeleteToken(token string) error {
+// DeleteUser removes the user. With transferTo documents are handed over to that user first,
+// otherwise they are deleted with the user and returned so the caller can clean up storage.
+// nil is returned if the user is the last admin.
+func (d *DB) DeleteUser(userId int64, transferTo int64) (*UserDeletion, error) {
 	tx, err := d.db.Beginx()
 	if err != nil {
-		return fmt.Errorf("Failed to delete token transaction. Error: %s ", err)
+		return nil, fmt.Errorf("Failed to create user transaction. Error: %s ", err)
 	}
+	defer tx.Rollback()
 
-	_, err = tx.Exec("DELETE FROM public.tokens WHERE token = $1", token)
+	if err := lockUsers(tx); err != nil {
+		return nil, err
+	}
+
+	var deletion UserDeletion
+	if transferTo != 0 {
+		res, err := tx.Exec("UPDATE public.docs SET owner_id = $2 WHERE owner_id = $1", userId, transferTo)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to transfer docs. Error: %s ", err)
+		}
+		if deletion.Transferred, err = res.RowsAffected(); err != nil {
+			return nil, fmt.Errorf("Failed to transfer docs. Error: %s ", err)
+		}
+
+		_, err = tx.Exec("UPDATE public.groups SET owner_id = $2 WHERE owner_id = $1", userId, transferTo)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to transfer groups. Error: %s ", err)
+		}
+
+		// links keep working while the new creator can share the doc
+		_, err = tx.Exec("UPDATE public.share_links SET created_by = $2 WHERE created_by = $1", userId, transferTo)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to transfer share links. Error: %s ", err)
+		}
+
+		// the new owner doesn't need grants to own docs
+		_, err = tx.Exec(`DELETE FROM public.users_docs_grant g USING public.docs d
+			WHERE g.doc_id = d.id AND d.owner_id = $1 AND g.user_id = $1`, transferTo)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to clean up grants. Error: %s ", err)
+		}
+	}
+
+	err = tx.Select(&deletion.Purged, "SELECT id, filename, object_key FROM public.docs WHERE owner_id = $1", userId)
 	if err != nil {
-		return fmt.Errorf("Failed to delete token. Error: %s ", err)
+		return nil, fmt.Errorf("Failed to get user docs. Error: %s ", err)
+	}
+
+	res, err := tx.Exec(`DELETE FROM public.users WHERE id = $1
+		AND (role <> $2 OR (SELECT count(*) FROM public.users WHERE role = $2) > 1)`, userId, RoleAdmin)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to delete user. Error: %s ", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to delete user. Error: %s ", err)
+	}
+	if n == 0 {
+		return nil, nil
 	}
 
 	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("Failed to commit token delete. Error: %s ", err)
+		return nil, fmt.Errorf("Failed to commit user delete. Error: %s ", err)
 	}
+	return &deletion, nil
+}
 
+func (d *DB) CreateServiceAccount(login string) error {
+	_, err := d.db.Exec("INSERT INTO public.users (login, password, service_account) VALUES ($1, '', true)", login)
+	if err != nil {
+		return fmt.Errorf("Failed to create service account. Error: %s ", err)
+	}
 	return nil
+}
 
+func (d *DB) UpdateUserPassword(userId int64, passwordHash string) error {
+	_, err := d.db.Exec("UPDATE public.users SET password = $2 WHERE id = $1", userId, passwordHash)
+	if err != nil {
+		return fmt.Errorf("Failed to update user password. Error: %s ", err)
+	}
+	return nil
 }
 
-func (d *DB) GetDocs() (map[string]Doc, error) {
-	var docs []Doc
+func (d *DB) CreatePasswordReset(userId int64, ttl time.Duration) (string, time.Time, error) {
+	token, err := GenerateSecureToken()
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Failed to generate reset token. Error: %s", err)
+	}
 
-	err := d.db.Select(&docs, "SELECT id, filename, public, mime, owner_id, created FROM public.docs")
+	tx, err := d.db.Beginx()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get docs from db. Error: %s ", err)
+		return "", time.Time{}, fmt.Errorf("Failed to create password reset transaction. Error: %s ", err)
 	}
+	defer tx.Rollback()
 
-	var userDocGrants []UsersDocsGrant
-	err = d.db.Select(&userDocGrants, "SELECT user_id, doc_id FROM public.users_docs_grant")
+	_, err = tx.Exec("DELETE FROM public.password_resets WHERE user_id = $1", userId)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get user doc grants from db. Error: %s ", err)
+		return "", time.Time{}, fmt.Errorf("Failed to delete previous password resets. Error: %s ", err)
 	}
 
-	docsMap := make(map[string]Doc)
-	for _, doc := range docs {
-		grantUserIds := make([]int64, 0)
-		for _, udg := range userDocGrants {
-			if udg.DocId == doc.Id {
-				grantUserIds = append(grantUserIds, udg.UserId)
-			}
-		}
-		doc.GrantIds = grantUserIds
-		docsMap[doc.Filename] = doc
+	expiresAt := time.Now().UTC().Add(ttl)
+	_, err = tx.Exec("INSERT INTO public.password_resets (user_id, token_hash, expires_at) VALUES ($1, $2, $3)", userId, HashToken(token), expiresAt)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Failed to create password reset. Error: %s ", err)
 	}
-	return docsMap, nil
+
+	if err := tx.Commit(); err != nil {
+		return "", time.Time{}, fmt.Errorf("Failed to commit password reset. Error: %s ", err)
+	}
+	return token, expiresAt, nil
 }
 
-func (d *DB) CreateDoc(filename string, public bool, mime string, owner int64, grant []string) error {
+func (d *DB) ResetPassword(tokenHash string, passwordHash string) (bool, error) {
 	tx, err := d.db.Beginx()
 	if err != nil {
-		return fmt.Errorf("Failed to create doc transaction. Error: %s ", err)
+		return false, fmt.Errorf("Failed to create password reset transaction. Error: %s ", err)
 	}
+	defer tx.Rollback()
 
-	row := tx.QueryRowx("INSERT INTO public.docs (filename, public, mime, owner_id, created) VALUES ($1, $2, $3, $4, $5) RETURNING id", filename, public, mime, owner, time.Now().UTC())
-	if row.Err() != nil {
-		return fmt.Errorf("Failed to create new doc. Error: %s ", err)
+	var userIds []int64
+	err = tx.Select(&userIds, "DELETE FROM public.password_resets WHERE token_hash = $1 AND expires_at > $2 RETURNING user_id", tokenHash, time.Now().UTC())
+	if err != nil {
+		return false, fmt.Errorf("Failed to use password reset. Error: %s ", err)
 	}
-	var docId int64
-	err = row.Scan(&docId)
+	if len(userIds) == 0 {
+		return false, nil
+	}
+
+	_, err = tx.Exec("UPDATE public.users SET password = $2 WHERE id = $1", userIds[0], passwordHash)
 	if err != nil {
-		return fmt.Errorf("Failed to scan doc id from row. Error: %s ", err)
+		return false, fmt.Errorf("Failed to update user password. Error: %s ", err)
 	}
 
-	if !public && len(grant) != 0 {
-		var userIds []int64
-		err := tx.Select(&userIds, "SELECT id FROM public.users WHERE login = ANY($1) AND id != $2", pq.Array(grant), owner)
-		if err != nil {
-			return fmt.Errorf("Failed to get users by grant string. Error: %s ", err)
-		}
+	_, err = tx.Exec("DELETE FROM public.tokens WHERE user_id = $1", userIds[0])
+	if err != nil {
+		return false, fmt.Errorf("Failed to delete user tokens. Error: %s ", err)
+	}
 
-		for _, uid := range userIds {
-			_, err := tx.Exec("INSERT INTO public.users_docs_grant (doc_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", docId, uid)
-			if err != nil {
-				return fmt.Errorf("Failed to insert user doc grant. Error: %s ", err)
-			}
+	_, err = tx.Exec("DELETE FROM public.api_keys WHERE user_id = $1", userIds[0])
+	if err != nil {
+		return false, fmt.Errorf("Failed to delete user api keys. Error: %s ", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("Failed to commit password reset. Error: %s ", err)
+	}
+	return true, nil
+}
+
+func (d *DB) SetTOTPSecret(userId int64, secret string) error {
+	_, err := d.db.Exec("UPDATE public.users SET totp_secret = $2, totp_enabled = false, totp_last_step = 0 WHERE id = $1", userId, secret)
+	if err != nil {
+		return fmt.Errorf("Failed to set totp secret. Error: %s ", err)
+	}
+	return nil
+}
+
+func (d *DB) EnableTOTP(userId int64, step int64, codeHashes []string) error {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("Failed to create totp transaction. Error: %s ", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE public.users SET totp_enabled = true, totp_last_step = $2 WHERE id = $1", userId, step)
+	if err != nil {
+		return fmt.Errorf("Failed to enable totp. Error: %s ", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM public.recovery_codes WHERE user_id = $1", userId)
+	if err != nil {
+		return fmt.Errorf("Failed to delete recovery codes. Error: %s ", err)
+	}
+
+	for _, hash := range codeHashes {
+		_, err = tx.Exec("INSERT INTO public.recovery_codes (user_id, code_hash) VALUES ($1, $2)", userId, hash)
+		if err != nil {
+			return fmt.Errorf("Failed to create recovery code. Error: %s ", err)
 		}
 	}
 
 	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("Failed to commit created doc. Error: %s ", err)
+		return fmt.Errorf("Failed to commit totp. Error: %s ", err)
 	}
 	return nil
 }
 
-func (d *DB) DeleteDoc(id int64) error {
+// DisableTOTP turns 2FA off, API keys of the user are revoked as they were issued under 2FA.
+func (d *DB) DisableTOTP(userId int64) error {
 	tx, err := d.db.Beginx()
 	if err != nil {
-		return fmt.Errorf("Failed to doc token transaction. Error: %s ", err)
+		return fmt.Errorf("Failed to create totp transaction. Error: %s ", err)
 	}
+	defer tx.Rollback()
 
-	_, err = tx.Exec("DELETE FROM public.docs WHERE id = $1", id)
+	_, err = tx.Exec("UPDATE public.users SET totp_secret = '', totp_enabled = false, totp_last_step = 0 WHERE id = $1", userId)
 	if err != nil {
-		return fmt.Errorf("Failed to delete doc. Error: %s ", err)
+		return fmt.Errorf("Failed to disable totp. Error: %s ", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM public.recovery_codes WHERE user_id = $1", userId)
+	if err != nil {
+		return fmt.Errorf("Failed to delete recovery codes. Error: %s ", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM public.api_keys WHERE user_id = $1", userId)
+	if err != nil {
+		return fmt.Errorf("Failed to delete user api keys. Error: %s ", err)
 	}
 
 	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("Failed to commit doc delete. Error: %s ", err)
+		return fmt.Errorf("Failed to commit totp. Error: %s ", err)
 	}
+	return nil
+}
 
+func (d *DB) SetTOTPRequired(userId int64, required bool) error {
+	_, err := d.db.Exec("UPDATE public.users SET totp_required = $2 WHERE id = $1", userId, required)
+	if err != nil {
+		return fmt.Errorf("Failed to set totp requirement. Error: %s ", err)
+	}
 	return nil
 }
+
+// UseTOTPStep remembers the last accepted step, false is returned if the code was already used.
+func (d *DB) UseTOTPStep(userId int64, step int64) (bool, error) {
+	res, err := d.db.Exec("UPDATE public.users SET totp_last_step = $2 WHERE id = $1 AND totp_last_step < $2", userId, step)
+	if err != nil {
+		return false, fmt.Errorf("Failed to use totp code. Error: %s ", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Failed to use totp code. Error: %s ", err)
+	}
+	return n > 0, nil
+}
+
+func (d *DB) UseRecoveryCode(userId int64, codeHash string) (bool, error) {
+	res, err := d.db.Exec("DELETE FROM public.recovery_codes WHERE user_id = $1 AND code_hash = $2", userId, codeHash)
+	if err != nil {
+		return false, fmt.Errorf("Failed to use recovery code. Error: %s ", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Failed to use recovery code. Error: %s ", err)
+	}
+	return n > 0, nil
+}
+
+func (d *DB) GetUserByIds(ids []int64) ([]User, error) {
+	var users []User
+	err := d.db.Select(&users, "SELECT id, login, password FROM public.users WHERE id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get users from db. Error: %s ", err.Error())
+	}
+
+	return users, nil
+}
+
+func (d *DB) GetTokens() (map[string]UserToken, error) {
+	var userTokens []UserToken
+	err := d.db.Select(&userTokens, `SELECT u.id, t.id AS session_id, u.login, u.password, t.token_hash, t.issued_at, t.expires_at, t.last_used_at,
+		u.totp_enabled, u.totp_required, u.role, u.disabled FROM public.users u JOIN public.tokens t ON (u.id = t.user_id)`)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get tokens. Error: %s ", err)
+	}
+
+	userTokensMap := make(map[string]UserToken)
+	for _, ut := range userTokens {
+		userTokensMap[ut.TokenHash] = ut
+	}
+
+	return userTokensMap, nil
+}
+
+func (d *DB) GetAPIKeys() (map[string]APIKey, error) {
+	var keys []APIKey
+	err := d.db.Select(&keys, `SELECT k.id, k.user_id, u.login, k.name, k.prefix, k.key_hash, k.scopes, k.doc_prefix, k.created_at, k.last_used_at, u.role, u.disabled,
+		u.totp_enabled, u.totp_required FROM public.api_keys k JOIN public.users u ON (u.id = k.user_id)`)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get api keys. Error: %s ", err)
+	}
+
+	keysMap := make(map[string]APIKey)
+	for _, k := range keys {
+		keysMap[k.KeyHash] = k
+	}
+	return keysMap, nil
+}
+
+func (d *DB) GetUserAPIKeys(userId int64) ([]APIKey, error) {
+	var keys []APIKey
+	err := d.db.Select(&keys, `SELECT k.id, k.user_id, u.login, k.name, k.prefix, k.key_hash, k.scopes, k.doc_prefix, k.created_at, k.last_used_at, u.role, u.disabled,
+		u.totp_enabled, u.totp_required FROM public.api_keys k JOIN public.users u ON (u.id = k.user_id) WHERE k.user_id = $1 ORDER BY k.id`, userId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get api keys. Error: %s ", err)
+	}
+	return keys, nil
+}
+
+func (d *DB) CreateAPIKey(userId int64, name string, scopes []string, docPrefix string) (string, *APIKey, error) {
+	secret, err := GenerateSecureToken()
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to generate api key. Error: %s", err)
+	}
+	plain := apiKeyPrefix + secret
+
+	key := APIKey{
+		UserId:    userId,
+		Name:      truncate(name, 255),
+		Prefix:    plain[:len(apiKeyPrefix)+8],
+		KeyHash:   HashToken(plain),
+		Scopes:    scopes,
+		DocPrefix: docPrefix,
+		CreatedAt: time.Now().UTC(),
+	}
+	key.LastUsedAt = key.CreatedAt
+
+	err = d.db.Get(&key.Id, `INSERT INTO public.api_keys (user_id, name, prefix, key_hash, scopes, doc_prefix, created_at, last_used_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $7) RETURNING id`,
+		key.UserId, key.Name, key.Prefix, key.KeyHash, key.Scopes, key.DocPrefix, key.CreatedAt)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to create api key. Error: %s ", err)
+	}
+	return plain, &key, nil
+}
+
+func (d *DB) DeleteAPIKey(userId int64, id int64) (bool, error) {
+	res, err := d.db.Exec("DELETE FROM public.api_keys WHERE id = $1 AND user_id = $2", id, userId)
+	if err != nil {
+		return false, fmt.Errorf("Failed to delete api key. Error: %s ", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Failed to delete api key. Error: %s ", err)
+	}
+	return n > 0, nil
+}
+
+func (d *DB) DeleteUserAPIKeys(userId int64) (int64, error) {
+	res, err := d.db.Exec("DELETE FROM public.api_keys WHERE user_id = $1", userId)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to delete user api keys. Error: %s ", err)
+	}
+	return res.RowsAffected()
+}
+
+func (d *DB) TouchAPIKey(keyHash string, at time.Time) error {
+	_, err := d.db.Exec("UPDATE public.api_keys SET last_used_at = $2 WHERE key_hash = $1", keyHash, at)
+	if err != nil {
+		return fmt.Errorf("Failed to update api key usage. Error: %s ", err)
+	}
+	return nil
+}
+
+func (d *DB) CreateToken(userId int64, info SessionInfo, ttl time.Duration, refreshTTL time.Duration) (*IssuedToken, error) {
+	issued, err := newIssuedToken(ttl, refreshTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create token transaction. Error: %s ", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	_, err = tx.Exec(`INSERT INTO public.tokens (user_id, token_hash, refresh_hash, issued_at, expires_at, last_used_at, refresh_expires_at, device, user_agent, ip)
+		VALUES ($1, $2, $3, $4, $5, $4, $6, $7, $8, $9)`,
+		userId, HashToken(issued.Token), HashToken(issued.RefreshToken), now, issued.ExpiresAt, issued.RefreshExpiresAt,
+		truncate(info.Device, 255), truncate(info.UserAgent, 512), truncate(info.IP, 64))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create new token. Error: %s ", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("Failed to commit created token. Error: %s ", err)
+	}
+
+	return issued, nil
+}
+
+// RefreshToken rotates both tokens of the session found by the refresh token hash.
+// Returns nil if the refresh token is unknown, expired or the session has been idle for too long.
+func (d *DB) RefreshToken(refreshHash string, ttl time.Duration, refreshTTL time.Duration, idleTimeout time.Duration) (*IssuedToken, error) {
+	issued, err := newIssuedToken(ttl, refreshTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	res, err := d.db.Exec(`UPDATE public.tokens
+		SET token_hash = $2, refresh_hash = $3, issued_at = $4, expires_at = $5, last_used_at = $4, refresh_expires_at = $6
+		WHERE refresh_hash = $1 AND refresh_expires_at > $4 AND last_used_at > $7`,
+		refreshHash, HashToken(issued.Token), HashToken(issued.RefreshToken), now, issued.ExpiresAt, issued.RefreshExpiresAt, now.Add(-idleTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to refresh token. Error: %s ", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to refresh token. Error: %s ", err)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	return issued, nil
+}
+
+func (d *DB) GetSessions(userId int64) ([]Session, error) {
+	var sessions []Session
+	err := d.db.Select(&sessions, `SELECT id, token_hash, device, user_agent, ip, issued_at, expires_at, last_used_at
+		FROM public.tokens WHERE user_id = $1 ORDER BY last_used_at DESC`, userId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get sessions. Error: %s ", err)
+	}
+	return sessions, nil
+}
+
+func (d *DB) DeleteSession(userId int64, sessionId int64) (bool, error) {
+	res, err := d.db.Exec("DELETE FROM public.tokens WHERE id = $1 AND user_id = $2", sessionId, userId)
+	if err != nil {
+		return false, fmt.Errorf("Failed to delete session. Error: %s ", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Failed to delete session. Error: %s ", err)
+	}
+	return n > 0, nil
+}
+
+func (d *DB) DeleteOtherSessions(userId int64, keepSessionId int64) (int64, error) {
+	res, err := d.db.Exec("DELETE FROM public.tokens WHERE user_id = $1 AND id != $2", userId, keepSessionId)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to delete sessions. Error: %s ", err)
+	}
+	return res.RowsAffected()
+}
+
+func (d *DB) TouchToken(tokenHash string, at time.Time) error {
+	_, err := d.db.Exec("UPDATE public.tokens SET last_used_at = $2 WHERE token_hash = $1", tokenHash, at)
+	if err != nil {
+		return fmt.Errorf("Failed to update token last usage. Error: %s ", err)
+	}
+	return nil
+}
+
+func (d *DB) PurgeExpiredTokens(idleTimeout time.Duration) (int64, error) {
+	now := time.Now().UTC()
+	res, err := d.db.Exec("DELETE FROM public.tokens WHERE refresh_expires_at <= $1 OR last_used_at <= $2", now, now.Add(-idleTimeout))
+	if err != nil {
+		return 0, fmt.Errorf("Failed to purge expired tokens. Error: %s ", err)
+	}
+	return res.RowsAffected()
+}
+
+func (d *DB) GetToken(userId int64) (*Token, error) {
+	var tokens []Token
+
+	err := d.db.Select(tokens, "SELECT user_id, token_hash FROM public.tokens WHERE user_id = $1 LIMIT 1", userId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get token by user id. Error: %s ", err)
+	}
+
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	return &tokens[0], nil
+}
+
+func (d *DB) GetTokenByHash(tokenHash string) (*Token, error) {
+	var tokens []Token
+
+	err := d.db.Select(&tokens, "SELECT user_id, token_hash FROM public.tokens WHERE token_hash = $1 LIMIT 1", tokenHash)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get token by hash. Error: %s ", err)
+	}
+
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	return &tokens[0], nil
+}
+
+func (d *DB) DeleteUserTokens(userId int64) (int64, error) {
+	res, err := d.db.Exec("DELETE FROM public.tokens WHERE user_id = $1", userId)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to delete user tokens. Error: %s ", err)
+	}
+	return res.RowsAffected()
+}
+
+func (d *DB) DeleteToken(tokenHash string) error {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("Failed to delete token transaction. Error: %s ", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM public.tokens WHERE token_hash = $1", tokenHash)
+	if err != nil {
+		return fmt.Errorf("Failed to delete token. Error: %s ", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Failed to commit token delete. Error: %s ", err)
+	}
+
+	return nil
+
+}
+
+func (d *DB) GetDocs() (map[string]Doc, error) {
+	var docs []Doc
+
+	err := d.db.Select(&docs, "SELECT id, filename, public, mime, owner_id, created, status, signature, object_key, version, size, hash, modified FROM public.docs")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get docs from db. Error: %s ", err)
+	}
+
+	var userDocGrants []UsersDocsGrant
+	err = d.db.Select(&userDocGrants, "SELECT g.user_id, g.doc_id, u.login, g.permissions, g.expires_at FROM public.users_docs_grant g JOIN public.users u ON (u.id = g.user_id)")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get user doc grants from db. Error: %s ", err)
+	}
+
+	var groupDocGrants []DocsGroupGrant
+	err = d.db.Select(&groupDocGrants, "SELECT g.group_id, g.doc_id, gr.name, g.permissions, g.expires_at FROM public.docs_group_grant g JOIN public.groups gr ON (gr.id = g.group_id)")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get group doc grants from db. Error: %s ", err)
+	}
+
+	docsMap := make(map[string]Doc)
+	for _, doc := range docs {
+		doc.UserGrants = make(map[int64]DocGrant)
+		doc.GroupGrants = make(map[int64]DocGrant)
+		doc.Grant = make([]string, 0)
+		doc.Grants = make([]DocGrant, 0)
+		for _, udg := range userDocGrants {
+			if udg.DocId == doc.Id {
+				grant := DocGrant{Name: udg.Login, Permissions: udg.Permissions, ExpiresAt: udg.ExpiresAt}
+				doc.UserGrants[udg.UserId] = grant
+				doc.Grant = append(doc.Grant, udg.Login)
+				doc.Grants = append(doc.Grants, grant)
+			}
+		}
+		for _, gdg := range groupDocGrants {
+			if gdg.DocId == doc.Id {
+				grant := DocGrant{Name: groupGrantPrefix + gdg.Name, Permissions: gdg.Permissions, ExpiresAt: gdg.ExpiresAt}
+				doc.GroupGrants[gdg.GroupId] = grant
+				doc.Grant = append(doc.Grant, grant.Name)
+				doc.Grants = append(doc.Grants, grant)
+			}
+		}
+		docsMap[doc.Filename] = doc
+	}
+	return docsMap, nil
+}
+
+func (d *DB) CreateDoc(doc NewDoc) (int64, error) {
+	ids, err := d.CreateDocs([]NewDoc{doc})
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+func (d *DB) CreateDocs(docs []NewDoc) ([]int64, error) {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create doc transaction. Error: %s ", err)
+	}
+	defer tx.Rollback()
+
+	ids := make([]int64, 0, len(docs))
+	for _, doc := range docs {
+		docId, err := createDoc(tx, doc)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, docId)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("Failed to commit created doc. Error: %s ", err)
+	}
+	return ids, nil
+}
+
+func createDoc(tx *sqlx.Tx, doc NewDoc) (int64, error) {
+	row := tx.QueryRowx(`INSERT INTO public.docs (filename, public, mime, owner_id, created, status, signature, object_key, json, size, hash, modified)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $5) RETURNING id`,
+		doc.Filename, doc.Public, doc.Mime, doc.OwnerId, time.Now().UTC(), doc.Status, doc.Signature, doc.ObjectKey, doc.Json, doc.Size, doc.Hash)
+	if row.Err() != nil {
+		return 0, fmt.Errorf("Failed to create new doc. Error: %s ", row.Err())
+	}
+	var docId int64
+	err := row.Scan(&docId)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to scan doc id from row. Error: %s ", err)
+	}
+
+	if len(doc.Grant) != 0 {
+		if _, err := upsertGrants(tx, docId, doc.OwnerId, doc.Grant); err != nil {
+			return 0, err
+		}
+	}
+	return docId, nil
+}
+
+func (d *DB) UnresolvedGrantees(grants []GrantSpec) ([]string, error) {
+	var logins, groups []string
+	for _, g := range grants {
+		if g.IsGroup() {
+			groups = append(groups, strings.TrimPrefix(g.Name, groupGrantPrefix))
+		} else {
+			logins = append(logins, g.Name)
+		}
+	}
+
+	var found []string
+	err := d.db.Select(&found, `SELECT login FROM public.users WHERE login = ANY($1)
+		UNION SELECT $3 || name FROM public.groups WHERE name = ANY($2)`, pq.Array(logins), pq.Array(groups), groupGrantPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve grantees. Error: %s ", err)
+	}
+
+	known := make(map[string]bool, len(found))
+	for _, name := range found {
+		known[name] = true
+	}
+	unresolved := make([]string, 0)
+	for _, g := range grants {
+		if !known[g.Name] {
+			unresolved = append(unresolved, g.Name)
+		}
+	}
+	return unresolved, nil
+}
+
+func (d *DB) GetDocGrants(docId int64) ([]DocGrant, error) {
+	var grants []DocGrant
+	err := d.db.Select(&grants, `SELECT u.login AS name, g.permissions, g.expires_at FROM public.users_docs_grant g JOIN public.users u ON (u.id = g.user_id) WHERE g.doc_id = $1
+		UNION ALL SELECT $2 || gr.name, g.permissions, g.expires_at FROM public.docs_group_grant g JOIN public.groups gr ON (gr.id = g.group_id) WHERE g.doc_id = $1
+		ORDER BY name`, docId, groupGrantPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get doc grants. Error: %s ", err)
+	}
+	return grants, nil
+}
+
+func (d *DB) UpdateDocSharing(docId int64, ownerId int64, public *bool, replace bool, remove []string, grants []GrantSpec) ([]string, error) {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create sharing transaction. Error: %s ", err)
+	}
+	defer tx.Rollback()
+
+	if public != nil {
+		_, err = tx.Exec("UPDATE public.docs SET public = $2 WHERE id = $1", docId, *public)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to update doc. Error: %s ", err)
+		}
+	}
+
+	if replace {
+		if _, err = tx.Exec("DELETE FROM public.users_docs_grant WHERE doc_id = $1", docId); err != nil {
+			return nil, fmt.Errorf("Failed to delete user doc grants. Error: %s ", err)
+		}
+		if _, err = tx.Exec("DELETE FROM public.docs_group_grant WHERE doc_id = $1", docId); err != nil {
+			return nil, fmt.Errorf("Failed to delete group doc grants. Error: %s ", err)
+		}
+	}
+
+	unresolved := make([]string, 0)
+	for _, name := range remove {
+		var res sql.Result
+		if strings.HasPrefix(name, groupGrantPrefix) {
+			res, err = tx.Exec(`DELETE FROM public.docs_group_grant g USING public.groups gr
+				WHERE g.group_id = gr.id AND g.doc_id = $1 AND gr.name = $2`, docId, strings.TrimPrefix(name, groupGrantPrefix))
+		} else {
+			res, err = tx.Exec(`DELETE FROM public.users_docs_grant g USING public.users u
+				WHERE g.user_id = u.id AND g.doc_id = $1 AND u.login = $2`, docId, name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to delete doc grant. Error: %s ", err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			unresolved = append(unresolved, name)
+		}
+	}
+
+	notFound, err := upsertGrants(tx, docId, ownerId, grants)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("Failed to commit sharing. Error: %s ", err)
+	}
+	return append(unresolved, notFound...), nil
+}
+
+// DeleteExpiredGrants removes user and group grants whose time is over and leaves
+// a notification to the owner of every affected doc in the same transaction.
+func (d *DB) DeleteExpiredGrants() ([]ExpiredGrant, error) {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create grant sweep transaction. Error: %s ", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var expired []ExpiredGrant
+	err = tx.Select(&expired, `WITH users_expired AS (
+			DELETE FROM public.users_docs_grant g USING public.users u
+			WHERE g.user_id = u.id AND g.expires_at <= $1 RETURNING g.doc_id, u.login AS name
+		), groups_expired AS (
+			DELETE FROM public.docs_group_grant g USING public.groups gr
+			WHERE g.group_id = gr.id AND g.expires_at <= $1 RETURNING g.doc_id, $2 || gr.name AS name
+		)
+		SELECT e.doc_id, d.filename, d.owner_id, e.name
+		FROM (SELECT * FROM users_expired UNION ALL SELECT * FROM groups_expired) e JOIN public.docs d ON (d.id = e.doc_id)`,
+		now, groupGrantPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to delete expired grants. Error: %s ", err)
+	}
+
+	for _, g := range expired {
+		message := fmt.Sprintf("Access of %s to %s has expired", g.Name, g.Filename)
+		if err := createNotification(tx, g.OwnerId, message, now); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("Failed to commit grant sweep. Error: %s ", err)
+	}
+	return expired, nil
+}
+
+func createNotification(tx *sqlx.Tx, userId int64, message string, created time.Time) error {
+	_, err := tx.Exec("INSERT INTO public.notifications (user_id, message, created) VALUES ($1, $2, $3)", userId, message, created)
+	if err != nil {
+		return fmt.Errorf("Failed to create notification. Error: %s ", err)
+	}
+	return nil
+}
+
+func (d *DB) GetNotifications(userId int64) ([]Notification, error) {
+	var notifications []Notification
+	err := d.db.Select(&notifications, "SELECT id, user_id, message, created FROM public.notifications WHERE user_id = $1 ORDER BY created DESC, id DESC", userId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get notifications. Error: %s ", err)
+	}
+	return notifications, nil
+}
+
+func (d *DB) DeleteNotification(userId int64, id int64) (bool, error) {
+	res, err := d.db.Exec("DELETE FROM public.notifications WHERE id = $1 AND user_id = $2", id, userId)
+	if err != nil {
+		return false, fmt.Errorf("Failed to delete notification. Error: %s ", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Failed to delete notification. Error: %s ", err)
+	}
+	return n > 0, nil
+}
+
+func (d *DB) CreateShareLink(link ShareLink) (int64, error) {
+	var id int64
+	err := d.db.Get(&id, `INSERT INTO public.share_links (doc_id, slug, created_by, password_hash, expires_at, max_downloads, downloads, created)
+		VALUES ($1, $2, $3, $4, $5, $6, 0, $7) RETURNING id`,
+		link.DocId, link.Slug, link.CreatedBy, link.PasswordHash, link.ExpiresAt, link.MaxDownloads, link.Created)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to create share link. Error: %s ", err)
+	}
+	return id, nil
+}
+
+func (d *DB) GetShareLinks(docId int64) ([]ShareLink, error) {
+	var links []ShareLink
+	err := d.db.Select(&links, `SELECT id, doc_id, slug, created_by, password_hash, expires_at, max_downloads, downloads, created
+		FROM public.share_links WHERE doc_id = $1 ORDER BY id`, docId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get share links. Error: %s ", err)
+	}
+	return links, nil
+}
+
+func (d *DB) GetShareLink(slug string) (*ShareLink, error) {
+	var links []ShareLink
+	err := d.db.Select(&links, `SELECT id, doc_id, slug, created_by, password_hash, expires_at, max_downloads, downloads, created
+		FROM public.share_links WHERE slug = $1`, slug)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get share link. Error: %s ", err)
+	}
+	if len(links) == 0 {
+		return nil, nil
+	}
+	return &links[0], nil
+}
+
+func (d *DB) DeleteShareLink(docId int64, id int64) (bool, error) {
+	res, err := d.db.Exec("DELETE FROM public.share_links WHERE id = $1 AND doc_id = $2", id, docId)
+	if err != nil {
+		return false, fmt.Errorf("Failed to delete share link. Error: %s ", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Failed to delete share link. Error: %s ", err)
+	}
+	return n > 0, nil
+}
+
+// UseShareLink counts a download, false is returned if the link expired or ran out of downloads meanwhile.
+func (d *DB) UseShareLink(id int64) (bool, error) {
+	res, err := d.db.Exec(`UPDATE public.share_links SET downloads = downloads + 1
+		WHERE id = $1 AND (expires_at IS NULL OR expires_at > $2) AND (max_downloads IS NULL OR downloads < max_downloads)`,
+		id, time.Now().UTC())
+	if err != nil {
+		return false, fmt.Errorf("Failed to use share link. Error: %s ", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Failed to use share link. Error: %s ", err)
+	}
+	return n > 0, nil
+}
+
+func (d *DB) LogShareAccess(linkId int64, access ShareAccess) error {
+	_, err := d.db.Exec("INSERT INTO public.share_link_access (link_id, at, ip, user_agent, result) VALUES ($1, $2, $3, $4, $5)",
+		linkId, access.At, truncate(access.IP, 64), truncate(access.UserAgent, 512), access.Result)
+	if err != nil {
+		return fmt.Errorf("Failed to log share link access. Error: %s ", err)
+	}
+	return nil
+}
+
+func (d *DB) GetShareAccessLog(linkId int64) ([]ShareAccess, error) {
+	var log []ShareAccess
+	err := d.db.Select(&log, "SELECT at, ip, user_agent, result FROM public.share_link_access WHERE link_id = $1 ORDER BY at DESC", linkId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get share link access log. Error: %s ", err)
+	}
+	return log, nil
+}
+
+// upsertGrants grants permissions to users and "@groups", existing grants get the new permissions.
+// Names that match neither a user nor a group are returned. The owner is never added as a grantee.
+func upsertGrants(tx *sqlx.Tx, docId int64, ownerId int64, grants []GrantSpec) ([]string, error) {
+	var logins, groups []string
+	for _, g := range grants {
+		if g.IsGroup() {
+			groups = append(groups, strings.TrimPrefix(g.Name, groupGrantPrefix))
+		} else {
+			logins = append(logins, g.Name)
+		}
+	}
+
+	var groupRows []Group
+	err := tx.Select(&groupRows, "SELECT id, name FROM public.groups WHERE name = ANY($1)", pq.Array(groups))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get groups by grant string. Error: %s ", err)
+	}
+	groupIds := make(map[string]int64, len(groupRows))
+	for _, g := range groupRows {
+		groupIds[groupGrantPrefix+g.Name] = g.Id
+	}
+
+	var userRows []User
+	err = tx.Select(&userRows, "SELECT id, login FROM public.users WHERE login = ANY($1)", pq.Array(logins))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get users by grant string. Error: %s ", err)
+	}
+	userIds := make(map[string]int64, len(userRows))
+	for _, u := range userRows {
+		userIds[u.Login] = u.Id
+	}
+
+	unresolved := make([]string, 0)
+	for _, g := range grants {
+		if gid, ok := groupIds[g.Name]; ok {
+			_, err := tx.Exec(`INSERT INTO public.docs_group_grant (doc_id, group_id, permissions, expires_at) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (doc_id, group_id) DO UPDATE SET permissions = EXCLUDED.permissions, expires_at = EXCLUDED.expires_at`, docId, gid, g.Permissions, g.ExpiresAt)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to insert group doc grant. Error: %s ", err)
+			}
+			continue
+		}
+		uid, ok := userIds[g.Name]
+		if !ok {
+			unresolved = append(unresolved, g.Name)
+			continue
+		}
+		if uid == ownerId {
+			continue
+		}
+		_, err := tx.Exec(`INSERT INTO public.users_docs_grant (doc_id, user_id, permissions, expires_at) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (doc_id, user_id) DO UPDATE SET permissions = EXCLUDED.permissions, expires_at = EXCLUDED.expires_at`, docId, uid, g.Permissions, g.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to insert user doc grant. Error: %s ", err)
+		}
+	}
+	return unresolved, nil
+}
+
+func (d *DB) GetGroups() ([]Group, error) {
+	var groups []Group
+	err := d.db.Select(&groups, `SELECT g.id, g.name, g.owner_id, u.login AS owner_login, g.created
+		FROM public.groups g JOIN public.users u ON (u.id = g.owner_id) ORDER BY g.name`)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get groups from db. Error: %s ", err)
+	}
+
+	var members []GroupMember
+	err = d.db.Select(&members, `SELECT m.group_id, m.user_id, u.login
+		FROM public.group_members m JOIN public.users u ON (u.id = m.user_id) ORDER BY u.login`)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get group members from db. Error: %s ", err)
+	}
+
+	for i := range groups {
+		groups[i].Members = make([]string, 0)
+		for _, m := range members {
+			if m.GroupId == groups[i].Id {
+				groups[i].Members = append(groups[i].Members, m.Login)
+			}
+		}
+	}
+	return groups, nil
+}
+
+func (d *DB) GetGroup(name string) (*Group, error) {
+	var groups []Group
+	err := d.db.Select(&groups, `SELECT g.id, g.name, g.owner_id, u.login AS owner_login, g.created
+		FROM public.groups g JOIN public.users u ON (u.id = g.owner_id) WHERE g.name = $1`, name)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get group from db. Error: %s ", err)
+	}
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	return &groups[0], nil
+}
+
+func (d *DB) GetGroupMemberships() (map[int64][]int64, error) {
+	var members []GroupMember
+	err := d.db.Select(&members, "SELECT group_id, user_id FROM public.group_members")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get group members from db. Error: %s ", err)
+	}
+
+	memberships := make(map[int64][]int64)
+	for _, m := range members {
+		memberships[m.UserId] = append(memberships[m.UserId], m.GroupId)
+	}
+	return memberships, nil
+}
+
+func (d *DB) CreateGroup(name string, ownerId int64) error {
+	_, err := d.db.Exec("INSERT INTO public.groups (name, owner_id, created) VALUES ($1, $2, $3)", name, ownerId, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("Failed to create group. Error: %s ", err)
+	}
+	return nil
+}
+
+func (d *DB) DeleteGroup(id int64) error {
+	_, err := d.db.Exec("DELETE FROM public.groups WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("Failed to delete group. Error: %s ", err)
+	}
+	return nil
+}
+
+func (d *DB) AddGroupMembers(groupId int64, logins []string) ([]string, error) {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create group transaction. Error: %s ", err)
+	}
+	defer tx.Rollback()
+
+	var users []User
+	err = tx.Select(&users, "SELECT id, login FROM public.users WHERE login = ANY($1)", pq.Array(logins))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get users by login. Error: %s ", err)
+	}
+
+	found := make(map[string]bool, len(users))
+	for _, u := range users {
+		found[u.Login] = true
+		_, err := tx.Exec("INSERT INTO public.group_members (group_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", groupId, u.Id)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to add group member. Error: %s ", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("Failed to commit group members. Error: %s ", err)
+	}
+
+	unresolved := make([]string, 0)
+	for _, login := range logins {
+		if !found[login] {
+			unresolved = append(unresolved, login)
+		}
+	}
+	return unresolved, nil
+}
+
+func (d *DB) RemoveGroupMember(groupId int64, login string) (bool, error) {
+	res, err := d.db.Exec(`DELETE FROM public.group_members m USING public.users u
+		WHERE m.user_id = u.id AND m.group_id = $1 AND u.login = $2`, groupId, login)
+	if err != nil {
+		return false, fmt.Errorf("Failed to remove group member. Error: %s ", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Failed to remove group member. Error: %s ", err)
+	}
+	return n > 0, nil
+}
+
+func (d *DB) SetDocStatus(id int64, status string, signature string) error {
+	_, err := d.db.Exec("UPDATE public.docs SET status = $2, signature = $3 WHERE id = $1", id, status, signature)
+	if err != nil {
+		return fmt.Errorf("Failed to update doc status. Error: %s ", err)
+	}
+	return nil
+}
+
+func (d *DB) GetPendingDocs() ([]Doc, error) {
+	var docs []Doc
+	err := d.db.Select(&docs, "SELECT id, filename, mime, object_key FROM public.docs WHERE status = $1 ORDER BY id", DocStatusPending)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get pending docs. Error: %s ", err)
+	}
+	return docs, nil
+}
+
+// SetPendingDocStatus stores the result of a rescan, false is returned if the doc was released,
+// deleted or got new content meanwhile.
+func (d *DB) SetPendingDocStatus(doc Doc, status string, signature string) (bool, error) {
+	res, err := d.db.Exec("UPDATE public.docs SET status = $4, signature = $5 WHERE id = $1 AND object_key = $2 AND status = $3",
+		doc.Id, doc.ObjectKey, DocStatusPending, status, signature)
+	if err != nil {
+		return false, fmt.Errorf("Failed to update doc status. Error: %s ", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Failed to update doc status. Error: %s ", err)
+	}
+	return n > 0, nil
+}
+
+func (d *DB) DeleteDoc(id int64) error {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("Failed to doc token transaction. Error: %s ", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM public.docs WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("Failed to delete doc. Error: %s ", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Failed to commit doc delete. Error: %s ", err)
+	}
+
+	return nil
+}
+
+// UpdateDocMeta applies the update if the doc has one of the expected versions, any version
+// matches if versions is nil. The new version is returned, false means the version didn't match.
+// The version stays the same when the update changes nothing, errDocExists is returned when
+// another doc already has the new name.
+func (d *DB) UpdateDocMeta(docId int64, versions []int64, update DocMetaUpdate) (int64, bool, error) {
+	var version int64
+	err := d.db.Get(&version, `UPDATE public.docs SET filename = COALESCE($3, filename), mime = COALESCE($4, mime),
+		json = CASE WHEN $5 THEN $6::jsonb ELSE json END,
+		version = CASE WHEN (COALESCE($3, filename), COALESCE($4, mime), CASE WHEN $5 THEN $6::jsonb ELSE json END)
+			IS DISTINCT FROM (filename, mime, json) THEN version + 1 ELSE version END
+		WHERE id = $1 AND ($2::integer[] IS NULL OR version = ANY($2)) RETURNING version`,
+		docId, pq.Array(versions), update.Filename, update.Mime, update.SetJson, update.Json)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqUniqueViolation {
+		return 0, false, errDocExists
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("Failed to update doc. Error: %s ", err)
+	}
+	return version, true, nil
+}
+
+// ReplaceDocContent points the doc to a new object if the doc has one of the expected versions,
+// any version matches if versions is nil. The new version and modification time are returned,
+// false means the version didn't match and the doc wasn't changed.
+func (d *DB) ReplaceDocContent(docId int64, versions []int64, content DocContent) (int64, time.Time, bool, error) {
+	modified := time.Now().UTC()
+	var version int64
+	err := d.db.Get(&version, `UPDATE public.docs SET object_key = $3, mime = $4, size = $5, hash = $6, status = $7,
+		signature = '', modified = $8, version = version + 1
+		WHERE id = $1 AND ($2::integer[] IS NULL OR version = ANY($2)) RETURNING version`,
+		docId, pq.Array(versions), content.ObjectKey, content.Mime, content.Size, content.Hash, content.Status, modified)
+	if err == sql.ErrNoRows {
+		return 0, modified, false, nil
+	}
+	if err != nil {
+		return 0, modified, false, fmt.Errorf("Failed to replace doc content. Error: %s ", err)
+	}
+	return version, modified, true, nil
+}
+
+func (d *DB) GetDocJson(docId int64) (*string, error) {
+	var data *string
+	err := d.db.Get(&data, "SELECT json FROM public.docs WHERE id = $1", docId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get doc json. Error: %s ", err)
+	}
+	return data, nil
+}
+
+func (d *DB) DeleteDocText(docId int64) error {
+	_, err := d.db.Exec("DELETE FROM public.docs_text WHERE doc_id = $1", docId)
+	if err != nil {
+		return fmt.Errorf("Failed to delete doc text. Error: %s ", err)
+	}
+	return nil
+}
+
+// SaveDocText stores the text only if the doc still has the content it was extracted from.
+func (d *DB) SaveDocText(doc Doc, content string) error {
+	_, err := d.db.Exec(`INSERT INTO public.docs_text (doc_id, content)
+		SELECT id, $2 FROM public.docs WHERE id = $1 AND object_key = $3 AND mime = $4
+		ON CONFLICT (doc_id) DO UPDATE SET content = EXCLUDED.content`, doc.Id, content, doc.ObjectKey, doc.Mime)
+	if err != nil {
+		return fmt.Errorf("Failed to save doc text. Error: %s ", err)
+	}
+	return nil
+}
+
+func (d *DB) DocContentIs(doc Doc) (bool, error) {
+	var exists bool
+	err := d.db.Get(&exists, "SELECT EXISTS (SELECT 1 FROM public.docs WHERE id = $1 AND object_key = $2 AND mime = $3)",
+		doc.Id, doc.ObjectKey, doc.Mime)
+	if err != nil {
+		return false, fmt.Errorf("Failed to check doc content. Error: %s ", err)
+	}
+	return exists, nil
+}
+
+func (d *DB) SearchDocs(query string) ([]int64, error) {
+	var ids []int64
+	err := d.db.Select(&ids, `SELECT t.doc_id FROM public.docs_text t, websearch_to_tsquery('simple', $1) q
+		WHERE t.tsv @@ q ORDER BY ts_rank(t.tsv, q) DESC, t.doc_id`, query)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to search docs. Error: %s ", err)
+	}
+	return ids, nil
+}
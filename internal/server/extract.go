@@ -0,0 +1,244 @@
+package server
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxExtractedTextSize = 1 << 20
+	extractQueueSize     = 100
+)
+
+type Extractor struct {
+	db   *DB
+	fs   *FileStorage
+	jobs chan Doc
+}
+
+func NewExtractor(db *DB, fs *FileStorage, workers int) *Extractor {
+	e := Extractor{
+		db:   db,
+		fs:   fs,
+		jobs: make(chan Doc, extractQueueSize),
+	}
+	for i := 0; i < workers; i++ {
+		go e.Run()
+	}
+	return &e
+}
+
+func (e *Extractor) Enqueue(doc Doc) {
+	if textExtractor(doc.Mime) == nil {
+		return
+	}
+	select {
+	case e.jobs <- doc:
+	default:
+		log.Warnf("Text extraction queue is full, skip doc %d", doc.Id)
+	}
+}
+
+func (e *Extractor) Run() {
+	for doc := range e.jobs {
+		if err := e.extract(doc); err != nil {
+			log.Errorf("Failed to extract text from doc %d. Error: %s", doc.Id, err)
+		}
+	}
+}
+
+func (e *Extractor) extract(doc Doc) error {
+	extract := textExtractor(doc.Mime)
+	if extract == nil {
+		return nil
+	}
+
+	data, err := e.fs.Get(context.Background(), MinioBucketName, doc.ObjectKey)
+	if err != nil {
+		return err
+	}
+
+	text, err := extract(data)
+	if err != nil {
+		return err
+	}
+
+	return e.db.SaveDocText(doc, sanitizeText(text))
+}
+
+func textExtractor(mime string) func([]byte) (string, error) {
+	mime = strings.ToLower(strings.TrimSpace(strings.SplitN(mime, ";", 2)[0]))
+	switch {
+	case mime == "text/html" || mime == "application/xhtml+xml":
+		return extractHTML
+	case mime == "application/json" || strings.HasSuffix(mime, "+json"):
+		return extractJSON
+	case mime == "application/pdf":
+		return extractPDF
+	case strings.HasPrefix(mime, "text/"):
+		return extractPlain
+	}
+	return nil
+}
+
+// sanitizeText makes text acceptable for postgres: valid utf8, no NUL bytes, bounded size.
+func sanitizeText(s string) string {
+	s = strings.ToValidUTF8(s, "")
+	s = strings.ReplaceAll(s, "\x00", "")
+	if len(s) > maxExtractedTextSize {
+		s = s[:maxExtractedTextSize]
+		for !utf8.ValidString(s) {
+			s = s[:len(s)-1]
+		}
+	}
+	return s
+}
+
+func extractPlain(data []byte) (string, error) {
+	return string(data), nil
+}
+
+func extractJSON(data []byte) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return "", fmt.Errorf("Failed to decode json. Error: %s ", err)
+	}
+
+	var parts []string
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch t := v.(type) {
+		case string:
+			parts = append(parts, t)
+		case []interface{}:
+			for _, item := range t {
+				walk(item)
+			}
+		case map[string]interface{}:
+			for key, item := range t {
+				parts = append(parts, key)
+				walk(item)
+			}
+		case nil:
+		default:
+			parts = append(parts, fmt.Sprint(t))
+		}
+	}
+	walk(v)
+
+	return strings.Join(parts, " "), nil
+}
+
+func extractHTML(data []byte) (string, error) {
+	var parts []string
+	skip := 0
+	z := html.NewTokenizer(bytes.NewReader(data))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return strings.Join(parts, " "), nil
+			}
+			return "", fmt.Errorf("Failed to parse html. Error: %s ", z.Err())
+		case html.StartTagToken:
+			if name, _ := z.TagName(); string(name) == "script" || string(name) == "style" {
+				skip++
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); (string(name) == "script" || string(name) == "style") && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip == 0 {
+				if text := strings.TrimSpace(string(z.Text())); text != "" {
+					parts = append(parts, text)
+				}
+			}
+		}
+	}
+}
+
+var (
+	pdfStreamRe = regexp.MustCompile(`(?s)<<(.*?)>>\s*stream\r?\n(.*?)\r?\nendstream`)
+	pdfTextRe   = regexp.MustCompile(`(?s)BT(.*?)ET`)
+	pdfStringRe = regexp.MustCompile(`\((?:\\.|[^\\)])*\)`)
+)
+
+// extractPDF handles simple PDFs: text drawn with literal strings in plain or Flate-compressed
+// content streams. Encrypted files, CID fonts and hex strings are not supported.
+func extractPDF(data []byte) (string, error) {
+	if !bytes.HasPrefix(data, []byte("%PDF")) {
+		return "", fmt.Errorf("Not a pdf file ")
+	}
+
+	var parts []string
+	for _, m := range pdfStreamRe.FindAllSubmatch(data, -1) {
+		content := m[2]
+		if bytes.Contains(m[1], []byte("/FlateDecode")) {
+			r, err := zlib.NewReader(bytes.NewReader(content))
+			if err != nil {
+				continue
+			}
+			content, err = io.ReadAll(io.LimitReader(r, maxExtractedTextSize*4))
+			r.Close()
+			if err != nil && len(content) == 0 {
+				continue
+			}
+		} else if bytes.Contains(m[1], []byte("/Filter")) {
+			continue
+		}
+
+		for _, block := range pdfTextRe.FindAllSubmatch(content, -1) {
+			var line []string
+			for _, s := range pdfStringRe.FindAll(block[1], -1) {
+				line = append(line, unescapePDFString(s[1:len(s)-1]))
+			}
+			if len(line) > 0 {
+				parts = append(parts, strings.Join(line, ""))
+			}
+		}
+	}
+
+	return strings.Join(parts, "\n"), nil
+}
+
+func unescapePDFString(s []byte) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteRune(rune(s[i]))
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'b', 'f':
+		case '\n':
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			n := 0
+			for j := 0; j < 3 && i < len(s) && s[i] >= '0' && s[i] <= '7'; j++ {
+				n = n*8 + int(s[i]-'0')
+				i++
+			}
+			i--
+			b.WriteRune(rune(byte(n)))
+		default:
+			b.WriteRune(rune(c))
+		}
+	}
+	return b.String()
+}
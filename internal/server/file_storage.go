@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"github.com/minio/minio-go/v7"
@@ -27,14 +28,16 @@ func NewFileStorage(minioDSN string) (*FileStorage, error) {
 		return nil, fmt.Errorf("Failed to create minio client. Error: %s ", err)
 	}
 
-	exists, err := client.BucketExists(context.Background(), MinioBucketName)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to check bucket exists ")
-	}
-	if !exists {
-		err = client.MakeBucket(context.Background(), MinioBucketName, minio.MakeBucketOptions{})
+	for _, bucket := range []string{MinioBucketName, MinioThumbnailsBucketName} {
+		exists, err := client.BucketExists(context.Background(), bucket)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to create bucket ")
+			return nil, fmt.Errorf("Failed to check bucket exists ")
+		}
+		if !exists {
+			err = client.MakeBucket(context.Background(), bucket, minio.MakeBucketOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("Failed to create bucket ")
+			}
 		}
 	}
 
@@ -42,3 +45,41 @@ func NewFileStorage(minioDSN string) (*FileStorage, error) {
 		client: client,
 	}, nil
 }
+
+func (f *FileStorage) Put(ctx context.Context, bucket string, key string, data []byte, contentType string) error {
+	_, err := f.client.PutObject(ctx, bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to put object to minio. Error: %s ", err)
+	}
+	return nil
+}
+
+func (f *FileStorage) Get(ctx context.Context, bucket string, key string) ([]byte, error) {
+	object, err := f.client.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get file from minio. Error: %s ", err)
+	}
+	defer object.Close()
+
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(object); err != nil {
+		return nil, fmt.Errorf("Failed to read file from minio. Error: %s ", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (f *FileStorage) RemoveThumbnails(ctx context.Context, docId int64) error {
+	opts := minio.ListObjectsOptions{Prefix: fmt.Sprintf("%d/", docId), Recursive: true}
+	for object := range f.client.ListObjects(ctx, MinioThumbnailsBucketName, opts) {
+		if object.Err != nil {
+			return fmt.Errorf("Failed to list thumbnails in minio. Error: %s ", object.Err)
+		}
+		err := f.client.RemoveObject(ctx, MinioThumbnailsBucketName, object.Key, minio.RemoveObjectOptions{})
+		if err != nil {
+			return fmt.Errorf("Failed to remove thumbnail from minio. Error: %s ", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+func (a *Api) runTokenPurge(interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := a.db.PurgeExpiredTokens(a.tokenIdleTimeout)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if n > 0 {
+			log.Infof("Purged %d expired tokens", n)
+			a.cache.Ch <- SyncTokens
+		}
+	}
+}
+
+func (a *Api) runPendingRescan(interval time.Duration) {
+	for range time.Tick(interval) {
+		docs, err := a.db.GetPendingDocs()
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		released := 0
+		for _, doc := range docs {
+			data, err := a.fs.Get(context.Background(), MinioBucketName, doc.ObjectKey)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+
+			result, err := a.scanner.Scan(context.Background(), bytes.NewReader(data))
+			if err != nil {
+				// the scanner is still down, the rest waits for the next run
+				log.Errorf("Failed to rescan doc %d. Error: %s", doc.Id, err)
+				break
+			}
+
+			status := DocStatusClean
+			if !result.Clean {
+				status = DocStatusInfected
+				log.Warnf("Doc %d quarantined, signature: %s", doc.Id, result.Signature)
+			}
+			ok, err := a.db.SetPendingDocStatus(doc, status, result.Signature)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			if ok && status == DocStatusClean {
+				a.enqueueProcessing(doc)
+				released++
+			}
+		}
+		if released > 0 {
+			log.Infof("Released %d pending docs after rescan", released)
+			a.cache.Ch <- SyncDocs
+		}
+	}
+}
+
+// runGrantSweep removes expired grants. Access checks already ignore them,
+// the sweep keeps the grant lists clean and tells owners what has expired.
+func (a *Api) runGrantSweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		expired, err := a.db.DeleteExpiredGrants()
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		for _, g := range expired {
+			log.Infof("Grant of %s to doc %d has expired, owner %d notified", g.Name, g.DocId, g.OwnerId)
+		}
+		if len(expired) > 0 {
+			a.cache.Ch <- SyncDocs
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jwtLeeway          = time.Minute
+	jwksMinReload      = time.Minute
+	jwksFetchTimeout   = 10 * time.Second
+	maxJWKSSize        = 1 << 20
+	maxLoginClaimLen   = 255
+	jwtDefaultLoginKey = "sub"
+	// joins iss and sub into the subject users are bound to
+	jwtSubjectSeparator = "|"
+)
+
+type JWTConfig struct {
+	// JWKS is a path to a file or an http(s) URL
+	JWKS     string
+	Issuer   string
+	Audience string
+	// LoginClaim only names users created by Provision, users are always bound to sub
+	LoginClaim string
+	// Provision creates a user on the first login with a valid JWT
+	Provision bool
+	Refresh   time.Duration
+}
+
+type JWTClaims struct {
+	// Login is empty if the token has no usable login claim
+	Login string
+	// Subject is "iss|sub", it is what local users are bound to
+	Subject   string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// JWTVerifier checks RS256 and ES256 tokens of an identity provider against its JWKS.
+// Keys are reloaded periodically and when a token refers to an unknown kid.
+type JWTVerifier struct {
+	cfg      JWTConfig
+	client   *http.Client
+	reloadMx sync.Mutex
+	mx       sync.RWMutex
+	keys     map[string]crypto.PublicKey
+	loadedAt time.Time
+}
+
+func NewJWTVerifier(cfg JWTConfig) (*JWTVerifier, error) {
+	if cfg.LoginClaim == "" {
+		cfg.LoginClaim = jwtDefaultLoginKey
+	}
+	v := JWTVerifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: jwksFetchTimeout},
+	}
+	if err := v.reload(); err != nil {
+		return nil, err
+	}
+	if cfg.Refresh > 0 {
+		go v.Run()
+	}
+	return &v, nil
+}
+
+func (v *JWTVerifier) Run() {
+	for range time.Tick(v.cfg.Refresh) {
+		if err := v.reload(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+func (v *JWTVerifier) reload() error {
+	v.reloadMx.Lock()
+	defer v.reloadMx.Unlock()
+	return v.load()
+}
+
+// load fetches the key set, the caller holds reloadMx. A failed attempt counts as a load too,
+// so tokens with unknown kids can't make every request wait for an unavailable provider.
+func (v *JWTVerifier) load() error {
+	v.mx.Lock()
+	v.loadedAt = time.Now()
+	v.mx.Unlock()
+
+	data, err := v.fetch()
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	v.mx.Lock()
+	defer v.mx.Unlock()
+	v.keys = keys
+	return nil
+}
+
+func (v *JWTVerifier) fetch() ([]byte, error) {
+	if !strings.HasPrefix(v.cfg.JWKS, "http://") && !strings.HasPrefix(v.cfg.JWKS, "https://") {
+		data, err := os.ReadFile(v.cfg.JWKS)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read jwks file. Error: %s ", err)
+		}
+		return data, nil
+	}
+
+	resp, err := v.client.Get(v.cfg.JWKS)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch jwks. Error: %s ", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch jwks. Status: %s ", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read jwks. Error: %s ", err)
+	}
+	return data, nil
+}
+
+// key returns the key by kid, the set is reloaded once if the kid is unknown since the provider may have rotated keys.
+func (v *JWTVerifier) key(kid string) (crypto.PublicKey, bool) {
+	key, ok, stale := v.cachedKey(kid)
+	if ok || !stale {
+		return key, ok
+	}
+
+	// concurrent requests wait for the reload in progress instead of starting their own
+	v.reloadMx.Lock()
+	if _, _, stale = v.cachedKey(kid); stale {
+		if err := v.load(); err != nil {
+			log.Error(err)
+		}
+	}
+	v.reloadMx.Unlock()
+
+	key, ok, _ = v.cachedKey(kid)
+	return key, ok
+}
+
+func (v *JWTVerifier) cachedKey(kid string) (crypto.PublicKey, bool, bool) {
+	v.mx.RLock()
+	defer v.mx.RUnlock()
+	key, ok := v.keys[kid]
+	return key, ok, time.Since(v.loadedAt) >= jwksMinReload
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("Failed to decode jwks. Error: %s ", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Warnf("Skip jwk %q. Error: %s", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("Jwks has no usable keys ")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid modulus ")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("Invalid exponent ")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("Unsupported curve %s ", k.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil {
+			return nil, fmt.Errorf("Invalid coordinates ")
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("Point is not on the curve ")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %s ", k.Kty)
+}
+
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func (v *JWTVerifier) Verify(token string) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Malformed jwt ")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	key, ok := v.key(header.Kid)
+	if !ok {
+		return nil, fmt.Errorf("Unknown jwt key %q ", header.Kid)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed jwt signature ")
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	return v.checkClaims(claims)
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("Malformed jwt ")
+	}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("Malformed jwt. Error: %s ", err)
+	}
+	return nil
+}
+
+// verifyJWTSignature accepts only the algorithm matching the key type, so "none" or HMAC tokens never pass.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			break
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return fmt.Errorf("Invalid jwt signature ")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" {
+			break
+		}
+		if len(sig) != 64 {
+			return fmt.Errorf("Invalid jwt signature ")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return fmt.Errorf("Invalid jwt signature ")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported jwt algorithm %s ", alg)
+}
+
+func (v *JWTVerifier) checkClaims(claims map[string]interface{}) (*JWTClaims, error) {
+	now := time.Now()
+
+	exp, ok := numericDate(claims["exp"])
+	if !ok {
+		return nil, fmt.Errorf("Jwt has no exp claim ")
+	}
+	if !now.Before(exp.Add(jwtLeeway)) {
+		return nil, fmt.Errorf("Jwt expired ")
+	}
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(jwtLeeway).Before(nbf) {
+		return nil, fmt.Errorf("Jwt is not valid yet ")
+	}
+	iat, _ := numericDate(claims["iat"])
+
+	if v.cfg.Issuer != "" && claims["iss"] != v.cfg.Issuer {
+		return nil, fmt.Errorf("Unexpected jwt issuer ")
+	}
+	if v.cfg.Audience != "" && !hasAudience(claims["aud"], v.cfg.Audience) {
+		return nil, fmt.Errorf("Unexpected jwt audience ")
+	}
+
+	// the login claim may be editable at the provider, so it never decides which user the token is
+	sub, _ := claims["sub"].(string)
+	if sub == "" || len(sub) > maxLoginClaimLen {
+		return nil, fmt.Errorf("Jwt has no valid sub claim ")
+	}
+	login, _ := claims[v.cfg.LoginClaim].(string)
+	if len(login) > maxLoginClaimLen {
+		login = ""
+	}
+
+	iss, _ := claims["iss"].(string)
+	return &JWTClaims{
+		Login:     login,
+		Subject:   iss + jwtSubjectSeparator + sub,
+		IssuedAt:  iat,
+		ExpiresAt: exp,
+	}, nil
+}
+
+func numericDate(v interface{}) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+func hasAudience(aud interface{}, expected string) bool {
+	switch t := aud.(type) {
+	case string:
+		return t == expected
+	case []interface{}:
+		for _, a := range t {
+			if a == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
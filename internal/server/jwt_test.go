@@ -0,0 +1,279 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://idp.test"
+	testAudience = "astral"
+)
+
+type testSigner struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+func (s testSigner) sign(t *testing.T, alg string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": s.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := s.key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, ss, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		ss.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func b64int(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func newTestVerifier(t *testing.T) (*JWTVerifier, testSigner, testSigner) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64int(rsaKey.N), "e": b64int(big.NewInt(int64(rsaKey.E)))},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64int(ecKey.X), "y": b64int(ecKey.Y)},
+		},
+	})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := NewJWTVerifier(JWTConfig{JWKS: path, Issuer: testIssuer, Audience: testAudience})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, testSigner{kid: "rsa", alg: "RS256", key: rsaKey}, testSigner{kid: "ec", alg: "ES256", key: ecKey}
+}
+
+func testClaims(mod func(map[string]interface{})) map[string]interface{} {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"sub": "ivanov",
+		"iss": testIssuer,
+		"aud": testAudience,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	if mod != nil {
+		mod(claims)
+	}
+	return claims
+}
+
+func TestJWTVerify(t *testing.T) {
+	v, rsaSigner, ecSigner := newTestVerifier(t)
+	now := time.Now()
+
+	noneToken := func(t *testing.T) string {
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa"}`))
+		payload, _ := json.Marshal(testClaims(nil))
+		return header + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+	}
+
+	tests := []struct {
+		name  string
+		token func(t *testing.T) string
+		err   string
+	}{
+		{"rs256", func(t *testing.T) string { return rsaSigner.sign(t, "RS256", testClaims(nil)) }, ""},
+		{"es256", func(t *testing.T) string { return ecSigner.sign(t, "ES256", testClaims(nil)) }, ""},
+		{"alg none", noneToken, "Unsupported jwt algorithm"},
+		{"es256 alg on rsa key", func(t *testing.T) string { return rsaSigner.sign(t, "ES256", testClaims(nil)) }, "Unsupported jwt algorithm"},
+		{"hs256 alg on rsa key", func(t *testing.T) string { return rsaSigner.sign(t, "HS256", testClaims(nil)) }, "Unsupported jwt algorithm"},
+		{"rs256 alg on ec key", func(t *testing.T) string { return ecSigner.sign(t, "RS256", testClaims(nil)) }, "Unsupported jwt algorithm"},
+		{"unknown kid", func(t *testing.T) string {
+			s := rsaSigner
+			s.kid = "rotated"
+			return s.sign(t, "RS256", testClaims(nil))
+		}, "Unknown jwt key"},
+		{"tampered payload", func(t *testing.T) string {
+			parts := strings.Split(rsaSigner.sign(t, "RS256", testClaims(nil)), ".")
+			payload, _ := json.Marshal(testClaims(func(c map[string]interface{}) { c["sub"] = "admin" }))
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+		}, "Invalid jwt signature"},
+		{"expired within leeway", func(t *testing.T) string {
+			return rsaSigner.sign(t, "RS256", testClaims(func(c map[string]interface{}) { c["exp"] = now.Add(-jwtLeeway / 2).Unix() }))
+		}, ""},
+		{"expired", func(t *testing.T) string {
+			return rsaSigner.sign(t, "RS256", testClaims(func(c map[string]interface{}) { c["exp"] = now.Add(-2 * jwtLeeway).Unix() }))
+		}, "Jwt expired"},
+		{"no exp", func(t *testing.T) string {
+			return rsaSigner.sign(t, "RS256", testClaims(func(c map[string]interface{}) { delete(c, "exp") }))
+		}, "Jwt has no exp claim"},
+		{"nbf within leeway", func(t *testing.T) string {
+			return rsaSigner.sign(t, "RS256", testClaims(func(c map[string]interface{}) { c["nbf"] = now.Add(jwtLeeway / 2).Unix() }))
+		}, ""},
+		{"nbf in future", func(t *testing.T) string {
+			return rsaSigner.sign(t, "RS256", testClaims(func(c map[string]interface{}) { c["nbf"] = now.Add(2 * jwtLeeway).Unix() }))
+		}, "Jwt is not valid yet"},
+		{"wrong iss", func(t *testing.T) string {
+			return rsaSigner.sign(t, "RS256", testClaims(func(c map[string]interface{}) { c["iss"] = "https://evil.test" }))
+		}, "Unexpected jwt issuer"},
+		{"wrong aud", func(t *testing.T) string {
+			return rsaSigner.sign(t, "RS256", testClaims(func(c map[string]interface{}) { c["aud"] = "other" }))
+		}, "Unexpected jwt audience"},
+		{"aud list", func(t *testing.T) string {
+			return rsaSigner.sign(t, "RS256", testClaims(func(c map[string]interface{}) { c["aud"] = []string{"other", testAudience} }))
+		}, ""},
+		{"no login claim", func(t *testing.T) string {
+			return rsaSigner.sign(t, "RS256", testClaims(func(c map[string]interface{}) { delete(c, "sub") }))
+		}, "Jwt has no valid sub claim"},
+		{"malformed", func(t *testing.T) string { return "a.b" }, "Malformed jwt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := v.Verify(tt.token(t))
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if claims.Login != "ivanov" || claims.Subject != testIssuer+jwtSubjectSeparator+"ivanov" {
+					t.Fatalf("unexpected claims: %+v", claims)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	tests := []struct {
+		name string
+		jwks string
+		keys int
+		err  bool
+	}{
+		{"not json", `{`, 0, true},
+		{"no keys", `{"keys": []}`, 0, true},
+		{"encryption keys are skipped", `{"keys": [{"kty": "RSA", "kid": "a", "use": "enc", "n": "AQAB", "e": "AQAB"}]}`, 0, true},
+		{"unsupported curve", `{"keys": [{"kty": "EC", "kid": "a", "crv": "P-384", "x": "AQ", "y": "AQ"}]}`, 0, true},
+		{"point not on curve", `{"keys": [{"kty": "EC", "kid": "a", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`, 0, true},
+		{"bad key is skipped", `{"keys": [{"kty": "oct", "kid": "a"}, {"kty": "RSA", "kid": "b", "n": "AQAB", "e": "AQAB"}]}`, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := parseJWKS([]byte(tt.jwks))
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if len(keys) != tt.keys {
+				t.Fatalf("expected %d keys, got %d", tt.keys, len(keys))
+			}
+		})
+	}
+}
+
+func TestJWTLoginClaim(t *testing.T) {
+	v, rsaSigner, _ := newTestVerifier(t)
+	v.cfg.LoginClaim = "email"
+
+	claims, err := v.Verify(rsaSigner.sign(t, "RS256", testClaims(func(c map[string]interface{}) {
+		c["sub"] = "42"
+		c["email"] = "ivanov@corp"
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Login != "ivanov@corp" || claims.Subject != testIssuer+jwtSubjectSeparator+"42" {
+		t.Fatalf("the subject must be built from sub, got %+v", claims)
+	}
+
+	claims, err = v.Verify(rsaSigner.sign(t, "RS256", testClaims(nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Login != "" || claims.Subject != testIssuer+jwtSubjectSeparator+"ivanov" {
+		t.Fatalf("unexpected claims without the login claim: %+v", claims)
+	}
+}
+
+func TestJWKSReloadFailure(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			w.Write([]byte(`{"keys": [{"kty": "RSA", "kid": "a", "n": "AQAB", "e": "AQAB"}]}`))
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	v, err := NewJWTVerifier(JWTConfig{JWKS: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.loadedAt = time.Now().Add(-2 * jwksMinReload)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := v.key("unknown"); ok {
+				t.Error("unknown kid must not be found")
+			}
+		}()
+	}
+	wg.Wait()
+	if _, ok := v.key("unknown"); ok {
+		t.Fatal("unknown kid must not be found")
+	}
+
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Fatalf("expected one reload while the provider is down, got %d", n-1)
+	}
+	if _, ok := v.key("a"); !ok {
+		t.Fatal("keys must be kept when the reload fails")
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	limiterFreeAttempts = 3
+	limiterBaseDelay    = time.Second
+	limiterCleanup      = 10 * time.Minute
+)
+
+type attemptState struct {
+	failures     int
+	blockedUntil time.Time
+	lastFailure  time.Time
+}
+
+// AttemptLimiter tracks failed attempts per key. After a few free attempts every next failure
+// doubles the delay before the key may try again, and after maxAttempts the key is locked out.
+type AttemptLimiter struct {
+	mx          sync.Mutex
+	attempts    map[string]*attemptState
+	maxAttempts int
+	lockout     time.Duration
+}
+
+func NewAttemptLimiter(maxAttempts int, lockout time.Duration) *AttemptLimiter {
+	l := AttemptLimiter{
+		attempts:    make(map[string]*attemptState),
+		maxAttempts: maxAttempts,
+		lockout:     lockout,
+	}
+	go l.Run()
+	return &l
+}
+
+func (l *AttemptLimiter) Run() {
+	for range time.Tick(limiterCleanup) {
+		l.mx.Lock()
+		now := time.Now()
+		for key, state := range l.attempts {
+			if now.After(state.blockedUntil) && now.Sub(state.lastFailure) > l.lockout {
+				delete(l.attempts, key)
+			}
+		}
+		l.mx.Unlock()
+	}
+}
+
+func (l *AttemptLimiter) Allow(key string) (bool, time.Duration) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	state, ok := l.attempts[key]
+	if !ok {
+		return true, 0
+	}
+	if wait := time.Until(state.blockedUntil); wait > 0 {
+		return false, wait
+	}
+	return true, 0
+}
+
+func (l *AttemptLimiter) Fail(key string) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	state, ok := l.attempts[key]
+	if !ok {
+		state = &attemptState{}
+		l.attempts[key] = state
+	}
+
+	now := time.Now()
+	// failures are forgotten after a quiet period as long as the lockout
+	if now.Sub(state.lastFailure) > l.lockout {
+		state.failures = 0
+	}
+	state.failures++
+	state.lastFailure = now
+
+	switch {
+	case state.failures >= l.maxAttempts:
+		state.blockedUntil = now.Add(l.lockout)
+	case state.failures > limiterFreeAttempts:
+		delay := limiterBaseDelay << uint(state.failures-limiterFreeAttempts-1)
+		if delay > l.lockout {
+			delay = l.lockout
+		}
+		state.blockedUntil = now.Add(delay)
+	}
+}
+
+func (l *AttemptLimiter) Reset(key string) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	delete(l.attempts, key)
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAttemptLimiterBackoff(t *testing.T) {
+	l := NewAttemptLimiter(10, time.Hour)
+
+	for i := 0; i < limiterFreeAttempts; i++ {
+		l.Fail("ivanov")
+		if ok, _ := l.Allow("ivanov"); !ok {
+			t.Fatalf("attempt %d must be free", i+1)
+		}
+	}
+
+	// every next failure doubles the delay
+	for i, expected := range []time.Duration{limiterBaseDelay, 2 * limiterBaseDelay, 4 * limiterBaseDelay} {
+		l.Fail("ivanov")
+		ok, wait := l.Allow("ivanov")
+		if ok || wait > expected || wait < expected-100*time.Millisecond {
+			t.Fatalf("failure %d: expected a wait of %s, got ok=%v wait=%s", limiterFreeAttempts+i+1, expected, ok, wait)
+		}
+	}
+
+	if ok, _ := l.Allow("petrov"); !ok {
+		t.Fatal("failures of one key must not block another")
+	}
+
+	l.Reset("ivanov")
+	if ok, _ := l.Allow("ivanov"); !ok {
+		t.Fatal("reset key must be allowed")
+	}
+}
+
+func TestAttemptLimiterLockout(t *testing.T) {
+	const lockout = time.Minute
+	l := NewAttemptLimiter(5, lockout)
+
+	for i := 0; i < 5; i++ {
+		l.Fail("ivanov")
+	}
+	ok, wait := l.Allow("ivanov")
+	if ok || wait < lockout-time.Second {
+		t.Fatalf("expected a lockout of %s, got ok=%v wait=%s", lockout, ok, wait)
+	}
+}
+
+func TestAttemptLimiterWindow(t *testing.T) {
+	// the lockout is shorter than the base delay, so every delay is capped by it
+	const lockout = 50 * time.Millisecond
+	l := NewAttemptLimiter(5, lockout)
+
+	for i := 0; i < 5; i++ {
+		l.Fail("ivanov")
+	}
+	if ok, wait := l.Allow("ivanov"); ok || wait > lockout {
+		t.Fatalf("expected a lockout capped at %s, got ok=%v wait=%s", lockout, ok, wait)
+	}
+
+	time.Sleep(2 * lockout)
+	if ok, _ := l.Allow("ivanov"); !ok {
+		t.Fatal("key must be allowed after the lockout")
+	}
+
+	// failures older than the lockout are forgotten, so the counter starts over
+	l.Fail("ivanov")
+	if ok, _ := l.Allow("ivanov"); !ok {
+		t.Fatal("first failure after a quiet period must be free")
+	}
+}
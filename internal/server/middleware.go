@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+type ctxKey int
+
+const (
+	userTokenCtxKey ctxKey = iota
+	legacyTokenCtxKey
+)
+
+// maxLegacyBodySize bounds the upload body read before authentication: a base64 file of
+// maxImportEntrySize with room for the meta.
+const maxLegacyBodySize = maxImportEntrySize/3*4 + 1<<20
+
+// requestToken returns the bearer token of the request. With legacy tokens enabled
+// it falls back to the token from upload meta and the ?token= query parameter.
+func (a *Api) requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if scheme, token, ok := strings.Cut(auth, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	if !a.legacyToken {
+		return ""
+	}
+	if token, ok := r.Context().Value(legacyTokenCtxKey).(string); ok && token != "" {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authenticate resolves the caller once and puts the UserToken into the request context.
+// Users who are required to use 2FA but haven't enrolled yet are rejected.
+func (a *Api) authenticate(next http.Handler) http.Handler {
+	return a.authenticateWith(next, false)
+}
+
+func (a *Api) authenticateEnrollment(next http.Handler) http.Handler {
+	return a.authenticateWith(next, true)
+}
+
+func (a *Api) authenticateWith(next http.Handler, enrollment bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := a.requestToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			a.writeError(w, r, http.StatusUnauthorized, "Authorization token required")
+			return
+		}
+
+		usertoken, err := a.identity(token)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			a.writeError(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		if !enrollment && usertoken.TotpRequired && !usertoken.TotpEnabled {
+			a.writeError(w, r, http.StatusForbidden, "Two-factor authentication must be enabled, use /api/auth/2fa/enroll")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userTokenCtxKey, usertoken)))
+	})
+}
+
+func (a *Api) requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !userToken(r).HasScope(scope) {
+				a.writeError(w, r, http.StatusForbidden, fmt.Sprintf("Not enough rights, %s scope is required", scope))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (a *Api) sessionOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if userToken(r).APIKeyID != 0 {
+			a.writeError(w, r, http.StatusForbidden, "API keys are not accepted here, log in with a password")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *Api) legacyMetaToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.legacyToken || r.Header.Get("Authorization") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// the body is buffered before the caller is known, so anyone could make the server hold it
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxLegacyBodySize))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				a.writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body is larger than %d bytes", maxLegacyBodySize))
+				return
+			}
+			a.writeError(w, r, http.StatusBadRequest, "Failed to read request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var input struct {
+			Meta struct {
+				Token string `json:"token"`
+			} `json:"meta"`
+		}
+		if err := json.Unmarshal(body, &input); err != nil || input.Meta.Token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), legacyTokenCtxKey, input.Meta.Token)))
+	})
+}
+
+func userToken(r *http.Request) *UserToken {
+	usertoken, _ := r.Context().Value(userTokenCtxKey).(*UserToken)
+	return usertoken
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Permission int
+
+const (
+	PermRead Permission = 1 << iota
+	PermWrite
+	PermShare
+	PermDelete
+
+	PermAll = PermRead | PermWrite | PermShare | PermDelete
+)
+
+var permissionNames = []struct {
+	perm Permission
+	name string
+}{
+	{PermRead, "read"},
+	{PermWrite, "write"},
+	{PermShare, "share"},
+	{PermDelete, "delete"},
+}
+
+func (p Permission) Has(perm Permission) bool {
+	return p&perm == perm
+}
+
+func (p Permission) Names() []string {
+	names := make([]string, 0, len(permissionNames))
+	for _, pn := range permissionNames {
+		if p.Has(pn.perm) {
+			names = append(names, pn.name)
+		}
+	}
+	return names
+}
+
+// ParsePermissions builds a set from names. Every grant allows reading, so read is always added.
+func ParsePermissions(names []string) (Permission, error) {
+	perm := PermRead
+	for _, name := range names {
+		found := false
+		for _, pn := range permissionNames {
+			if pn.name == strings.TrimSpace(name) {
+				perm |= pn.perm
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("Unknown permission %q ", name)
+		}
+	}
+	return perm, nil
+}
+
+// GrantSpec is an entry of a grant list: a login or "@group" with permissions.
+// In json it is either a string "login", "login:read,write" or an object
+// {"login": "login", "permissions": ["read", "write"], "expires_at": "2024-05-01T00:00:00Z"}.
+// Without permissions only reading is granted, without expires_at the grant doesn't expire.
+type GrantSpec struct {
+	Name        string
+	Permissions Permission
+	ExpiresAt   *time.Time
+}
+
+func ParseGrantSpec(s string) (GrantSpec, error) {
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		if perm, err := ParsePermissions(strings.Split(s[i+1:], ",")); err == nil {
+			return GrantSpec{Name: s[:i], Permissions: perm}, nil
+		}
+	}
+	if s == "" {
+		return GrantSpec{}, fmt.Errorf("Empty grant ")
+	}
+	return GrantSpec{Name: s, Permissions: PermRead}, nil
+}
+
+func (g *GrantSpec) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		spec, err := ParseGrantSpec(s)
+		if err != nil {
+			return err
+		}
+		*g = spec
+		return nil
+	}
+
+	var obj struct {
+		Login       string   `json:"login"`
+		Permissions []string `json:"permissions"`
+		ExpiresAt   *string  `json:"expires_at"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return fmt.Errorf("Grant must be a login or an object with login and permissions ")
+	}
+	if obj.Login == "" {
+		return fmt.Errorf("Empty grant ")
+	}
+	perm, err := ParsePermissions(obj.Permissions)
+	if err != nil {
+		return err
+	}
+	*g = GrantSpec{Name: obj.Login, Permissions: perm}
+
+	if obj.ExpiresAt != nil {
+		expiresAt, err := time.Parse(time.RFC3339, *obj.ExpiresAt)
+		if err != nil {
+			return fmt.Errorf("Grant expires_at must be RFC3339 time. Error: %s ", err)
+		}
+		if !expiresAt.After(time.Now()) {
+			return fmt.Errorf("Grant expires_at must be in the future ")
+		}
+		expiresAt = expiresAt.UTC()
+		g.ExpiresAt = &expiresAt
+	}
+	return nil
+}
+
+func (g GrantSpec) IsGroup() bool {
+	return strings.HasPrefix(g.Name, groupGrantPrefix)
+}
+
+// docPermissions returns what the caller may do with the document: owners may do everything,
+// others get the union of public read access, personal grants and grants of their groups.
+// Expired grants are ignored even before the sweeper removes them.
+// API keys never reach documents outside of their prefix.
+func docPermissions(ut *UserToken, doc Doc) Permission {
+	if !ut.InDocPrefix(doc.Filename) {
+		return 0
+	}
+	if doc.OwnerId == ut.UserID {
+		return PermAll
+	}
+
+	now := time.Now().UTC()
+	var perm Permission
+	if doc.Public {
+		perm |= PermRead
+	}
+	if g, ok := doc.UserGrants[ut.UserID]; ok && g.Active(now) {
+		perm |= g.Permissions
+	}
+	for _, gid := range ut.GroupIds {
+		if g, ok := doc.GroupGrants[gid]; ok && g.Active(now) {
+			perm |= g.Permissions
+		}
+	}
+	return perm
+}
+
+func permissionExpiry(ut *UserToken, doc Doc, perm Permission) *time.Time {
+	if doc.OwnerId == ut.UserID {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	grants := make([]DocGrant, 0, len(ut.GroupIds)+1)
+	if g, ok := doc.UserGrants[ut.UserID]; ok {
+		grants = append(grants, g)
+	}
+	for _, gid := range ut.GroupIds {
+		if g, ok := doc.GroupGrants[gid]; ok {
+			grants = append(grants, g)
+		}
+	}
+
+	var latest *time.Time
+	for _, g := range grants {
+		if !g.Active(now) || !g.Permissions.Has(perm) {
+			continue
+		}
+		if g.ExpiresAt == nil {
+			return nil
+		}
+		if latest == nil || g.ExpiresAt.After(*latest) {
+			latest = g.ExpiresAt
+		}
+	}
+	return latest
+}
+
+func capGrantExpiry(grants []GrantSpec, limit *time.Time) {
+	if limit == nil {
+		return
+	}
+	for i := range grants {
+		if grants[i].ExpiresAt == nil || grants[i].ExpiresAt.After(*limit) {
+			expiresAt := *limit
+			grants[i].ExpiresAt = &expiresAt
+		}
+	}
+}
+
+func can(ut *UserToken, doc Doc, perm Permission) bool {
+	return docPermissions(ut, doc).Has(perm)
+}
+
+func canRead(ut *UserToken, doc Doc) bool {
+	return can(ut, doc, PermRead)
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckGrantChanges(t *testing.T) {
+	doc := &Doc{
+		Grants: []DocGrant{
+			{Name: "writer", Permissions: PermRead | PermWrite},
+			{Name: "reader", Permissions: PermRead},
+		},
+	}
+	sharer := PermRead | PermShare
+
+	tests := []struct {
+		name   string
+		add    []GrantSpec
+		remove []string
+		ok     bool
+	}{
+		{"grant own permissions", []GrantSpec{{Name: "new", Permissions: PermRead | PermShare}}, nil, true},
+		{"grant more than own", []GrantSpec{{Name: "new", Permissions: PermRead | PermWrite}}, nil, false},
+		{"grant everything", []GrantSpec{{Name: "new", Permissions: PermAll}}, nil, false},
+		{"raise existing grant", []GrantSpec{{Name: "reader", Permissions: PermRead | PermDelete}}, nil, false},
+		{"downgrade grant with foreign permissions", []GrantSpec{{Name: "writer", Permissions: PermRead}}, nil, false},
+		{"regrant the same", []GrantSpec{{Name: "reader", Permissions: PermRead}}, nil, true},
+		{"revoke grant within own permissions", nil, []string{"reader"}, true},
+		{"revoke grant with foreign permissions", nil, []string{"writer"}, false},
+		{"revoke unknown grantee", nil, []string{"nobody"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkGrantChanges(sharer, doc, tt.add, tt.remove)
+			if (err == nil) != tt.ok {
+				t.Fatalf("expected ok=%v, got %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestGrantExpiry(t *testing.T) {
+	now := time.Now().UTC()
+	past, soon, later := now.Add(-time.Hour), now.Add(time.Hour), now.Add(24*time.Hour)
+	doc := Doc{
+		OwnerId: 1,
+		UserGrants: map[int64]DocGrant{
+			2: {Permissions: PermRead | PermShare, ExpiresAt: &soon},
+			3: {Permissions: PermAll, ExpiresAt: &past},
+			4: {Permissions: PermRead | PermShare},
+		},
+		GroupGrants: map[int64]DocGrant{
+			10: {Permissions: PermRead | PermShare, ExpiresAt: &later},
+			11: {Permissions: PermRead},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		ut      UserToken
+		perm    Permission
+		expires *time.Time
+	}{
+		{"owner", UserToken{UserID: 1}, PermRead | PermWrite | PermShare | PermDelete, nil},
+		{"expiring grant", UserToken{UserID: 2}, PermRead | PermShare, &soon},
+		{"expired grant is ignored", UserToken{UserID: 3}, 0, nil},
+		{"permanent grant", UserToken{UserID: 4}, PermRead | PermShare, nil},
+		{"latest of user and group grant", UserToken{UserID: 2, GroupIds: []int64{10}}, PermRead | PermShare, &later},
+		{"group without share", UserToken{UserID: 5, GroupIds: []int64{11}}, PermRead, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if perm := docPermissions(&tt.ut, doc); perm != tt.perm {
+				t.Fatalf("expected permissions %v, got %v", tt.perm.Names(), perm.Names())
+			}
+			expires := permissionExpiry(&tt.ut, doc, PermShare)
+			if (expires == nil) != (tt.expires == nil) || (expires != nil && !expires.Equal(*tt.expires)) {
+				t.Fatalf("expected expiry %v, got %v", tt.expires, expires)
+			}
+		})
+	}
+}
+
+func TestCapGrantExpiry(t *testing.T) {
+	now := time.Now().UTC()
+	limit, before, after := now.Add(time.Hour), now.Add(time.Minute), now.Add(2*time.Hour)
+	grants := []GrantSpec{{Name: "forever"}, {Name: "before", ExpiresAt: &before}, {Name: "after", ExpiresAt: &after}}
+
+	capGrantExpiry(grants, nil)
+	if grants[0].ExpiresAt != nil {
+		t.Fatal("grants must stay as they are without a limit")
+	}
+
+	capGrantExpiry(grants, &limit)
+	for i, expected := range []time.Time{limit, before, limit} {
+		if grants[i].ExpiresAt == nil || !grants[i].ExpiresAt.Equal(expected) {
+			t.Fatalf("%s: expected %v, got %v", grants[i].Name, expected, grants[i].ExpiresAt)
+		}
+	}
+}
+
+func TestParseGrantSpec(t *testing.T) {
+	tests := []struct {
+		spec string
+		name string
+		perm Permission
+		err  bool
+	}{
+		{"ivanov", "ivanov", PermRead, false},
+		{"ivanov:read,write", "ivanov", PermRead | PermWrite, false},
+		{"@finance:share", "@finance", PermRead | PermShare, false},
+		{"ivanov:unknown", "ivanov:unknown", PermRead, false},
+		{"", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			spec, err := ParseGrantSpec(tt.spec)
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if spec.Name != tt.name || spec.Permissions != tt.perm {
+				t.Fatalf("unexpected grant %+v", spec)
+			}
+		})
+	}
+}
+
+func TestIsLoginValid(t *testing.T) {
+	for login, ok := range map[string]bool{
+		"ivanov":                              true,
+		"ivan.ivanov@corp":                    true,
+		"":                                    false,
+		"ivanov:read":                         false,
+		"ivanov,petrov":                       false,
+		"@finance":                            false,
+		strings.Repeat("a", maxLoginLength+1): false,
+	} {
+		if IsLoginValid(login) != ok {
+			t.Errorf("IsLoginValid(%q) expected %v", login, ok)
+		}
+	}
+}
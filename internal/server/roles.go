@@ -0,0 +1,30 @@
+package server
+
+const (
+	RoleAdmin    = "admin"
+	RoleUser     = "user"
+	RoleReadonly = "readonly"
+)
+
+var Roles = []string{RoleAdmin, RoleUser, RoleReadonly}
+
+func IsRole(role string) bool {
+	for _, r := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func RoleAllows(role string, scope string) bool {
+	switch role {
+	case RoleAdmin:
+		return true
+	case RoleUser:
+		return scope != ScopeAdmin
+	case RoleReadonly:
+		return scope == ScopeDocsRead
+	}
+	return false
+}
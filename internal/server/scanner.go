@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	DocStatusPending  = "pending"
+	DocStatusClean    = "clean"
+	DocStatusInfected = "infected"
+)
+
+type ScanResult struct {
+	Clean     bool
+	Signature string
+}
+
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (ScanResult, error)
+}
+
+type NopScanner struct{}
+
+func (NopScanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	return ScanResult{Clean: true}, nil
+}
+
+const clamdChunkSize = 64 * 1024
+
+// ClamdScanner speaks the clamd INSTREAM protocol.
+// Address is either "unix:///path/to/clamd.sock", "tcp://host:port" or a plain socket path.
+type ClamdScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+func NewClamdScanner(addr string, timeout time.Duration) *ClamdScanner {
+	network, address := "unix", addr
+	if i := strings.Index(addr, "://"); i >= 0 {
+		network, address = addr[:i], addr[i+3:]
+	}
+	return &ClamdScanner{
+		network: network,
+		address: address,
+		timeout: timeout,
+	}
+}
+
+func (s *ClamdScanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("Failed to connect to clamd. Error: %s ", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return ScanResult{}, fmt.Errorf("Failed to set clamd deadline. Error: %s ", err)
+		}
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanResult{}, fmt.Errorf("Failed to send clamd command. Error: %s ", err)
+	}
+
+	buf := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, werr := conn.Write(size); werr != nil {
+				return ScanResult{}, fmt.Errorf("Failed to send chunk to clamd. Error: %s ", werr)
+			}
+			if _, werr := conn.Write(buf[:n]); werr != nil {
+				return ScanResult{}, fmt.Errorf("Failed to send chunk to clamd. Error: %s ", werr)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ScanResult{}, fmt.Errorf("Failed to read file for scanning. Error: %s ", err)
+		}
+	}
+
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return ScanResult{}, fmt.Errorf("Failed to finish clamd stream. Error: %s ", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\x00')
+	if err != nil && err != io.EOF {
+		return ScanResult{}, fmt.Errorf("Failed to read clamd reply. Error: %s ", err)
+	}
+
+	return parseClamdReply(reply)
+}
+
+func parseClamdReply(reply string) (ScanResult, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case reply == "OK":
+		return ScanResult{Clean: true}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return ScanResult{Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("Unexpected clamd reply: %s ", reply)
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd serves a single INSTREAM session. reply gets the streamed content and returns the answer,
+// an empty answer drops the connection. With limit > 0 the daemon answers as soon as the stream exceeds it.
+func fakeClamd(t *testing.T, limit int, reply func(data []byte) string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		rd := bufio.NewReader(conn)
+		cmd, err := rd.ReadString('\x00')
+		if err != nil || cmd != "zINSTREAM\x00" {
+			conn.Write([]byte("UNKNOWN COMMAND\x00"))
+			return
+		}
+
+		var data bytes.Buffer
+		size := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(rd, size); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(size)
+			if n == 0 {
+				break
+			}
+			if _, err := io.CopyN(&data, rd, int64(n)); err != nil {
+				return
+			}
+			if limit > 0 && data.Len() > limit {
+				conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+				return
+			}
+		}
+
+		if answer := reply(data.Bytes()); answer != "" {
+			conn.Write([]byte(answer + "\x00"))
+		}
+	}()
+	return "tcp://" + ln.Addr().String()
+}
+
+func TestClamdScanner(t *testing.T) {
+	eicar := []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+	verdict := func(data []byte) string {
+		if bytes.Contains(data, []byte("EICAR")) {
+			return "stream: Eicar FOUND"
+		}
+		return "stream: OK"
+	}
+
+	tests := []struct {
+		name      string
+		data      []byte
+		limit     int
+		reply     func([]byte) string
+		clean     bool
+		signature string
+		err       bool
+	}{
+		{"clean", []byte("hello"), 0, verdict, true, "", false},
+		{"clean larger than a chunk", bytes.Repeat([]byte("a"), 3*clamdChunkSize+1), 0, verdict, true, "", false},
+		{"infected", eicar, 0, verdict, false, "Eicar", false},
+		{"size limit exceeded", bytes.Repeat([]byte("a"), 2*clamdChunkSize), clamdChunkSize, verdict, false, "", true},
+		{"dropped connection", []byte("hello"), 0, func([]byte) string { return "" }, false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var streamed []byte
+			reply := func(data []byte) string {
+				streamed = append([]byte(nil), data...)
+				return tt.reply(data)
+			}
+			scanner := NewClamdScanner(fakeClamd(t, tt.limit, reply), 5*time.Second)
+
+			result, err := scanner.Scan(context.Background(), bytes.NewReader(tt.data))
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if result.Clean != tt.clean || result.Signature != tt.signature {
+				t.Fatalf("unexpected result %+v", result)
+			}
+			if !bytes.Equal(streamed, tt.data) {
+				t.Fatalf("daemon got %d bytes, expected %d", len(streamed), len(tt.data))
+			}
+		})
+	}
+}
+
+func TestClamdScannerUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	_, err = NewClamdScanner("tcp://"+addr, time.Second).Scan(context.Background(), strings.NewReader("hello"))
+	if err == nil {
+		t.Fatal("expected error for a closed socket")
+	}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	tests := []struct {
+		reply     string
+		clean     bool
+		signature string
+		err       bool
+	}{
+		{"stream: OK\x00", true, "", false},
+		{"stream: Eicar FOUND\x00", false, "Eicar", false},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND", false, "Win.Test.EICAR_HDB-1", false},
+		{"INSTREAM size limit exceeded. ERROR\x00", false, "", true},
+		{"", false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reply, func(t *testing.T) {
+			result, err := parseClamdReply(tt.reply)
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if result.Clean != tt.clean || result.Signature != tt.signature {
+				t.Fatalf("unexpected result %+v", result)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"strings"
+)
+
+const (
+	DefaultThumbnailSize = 128
+	maxThumbnailPixels   = 50 * 1000 * 1000
+	thumbnailQueueSize   = 100
+)
+
+var ThumbnailSizes = []int{64, 128, 256, 512}
+
+func IsThumbnailSize(size int) bool {
+	for _, s := range ThumbnailSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+func IsImageMime(mime string) bool {
+	return strings.HasPrefix(mime, "image/")
+}
+
+type Thumbnailer struct {
+	db   *DB
+	fs   *FileStorage
+	jobs chan Doc
+}
+
+func NewThumbnailer(db *DB, fs *FileStorage, workers int) *Thumbnailer {
+	t := Thumbnailer{
+		db:   db,
+		fs:   fs,
+		jobs: make(chan Doc, thumbnailQueueSize),
+	}
+	for i := 0; i < workers; i++ {
+		go t.Run()
+	}
+	return &t
+}
+
+func (t *Thumbnailer) Enqueue(doc Doc) {
+	if !IsImageMime(doc.Mime) {
+		return
+	}
+	select {
+	case t.jobs <- doc:
+	default:
+		log.Warnf("Thumbnail queue is full, skip doc %d", doc.Id)
+	}
+}
+
+func (t *Thumbnailer) Run() {
+	for doc := range t.jobs {
+		if err := t.generate(doc); err != nil {
+			log.Errorf("Failed to generate thumbnails for doc %d. Error: %s", doc.Id, err)
+		}
+	}
+}
+
+func (t *Thumbnailer) generate(doc Doc) error {
+	data, err := t.fs.Get(context.Background(), MinioBucketName, doc.ObjectKey)
+	if err != nil {
+		return err
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("Failed to decode image config. Error: %s ", err)
+	}
+	if cfg.Width*cfg.Height > maxThumbnailPixels {
+		return fmt.Errorf("Image is too large: %dx%d ", cfg.Width, cfg.Height)
+	}
+
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("Failed to decode image. Error: %s ", err)
+	}
+
+	// the content may have been replaced while the image was decoded
+	if current, err := t.db.DocContentIs(doc); err != nil || !current {
+		return err
+	}
+
+	for _, size := range ThumbnailSizes {
+		buf := new(bytes.Buffer)
+		contentType := "image/jpeg"
+		thumb := resizeImage(src, size)
+
+		// jpeg has no alpha channel, so keep png for everything except jpeg sources
+		if format == "jpeg" {
+			err = jpeg.Encode(buf, thumb, &jpeg.Options{Quality: 85})
+		} else {
+			contentType = "image/png"
+			err = png.Encode(buf, thumb)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to encode thumbnail. Error: %s ", err)
+		}
+
+		err = t.fs.Put(context.Background(), MinioThumbnailsBucketName, ThumbnailKey(doc.Id, doc.ObjectKey, size), buf.Bytes(), contentType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ThumbnailKey includes the object key, so a thumbnail of replaced content is never served for the new one.
+func ThumbnailKey(docId int64, objectKey string, size int) string {
+	return fmt.Sprintf("%d/%s/%d", docId, objectKey, size)
+}
+
+func resizeImage(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if w > size || h > size {
+		if w >= h {
+			dw, dh = size, h*size/w
+		} else {
+			dw, dh = w*size/h, size
+		}
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA64(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy0 := b.Min.Y + y*h/dh
+		sy1 := b.Min.Y + (y+1)*h/dh
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < dw; x++ {
+			sx0 := b.Min.X + x*w/dw
+			sx1 := b.Min.X + (x+1)*w/dw
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
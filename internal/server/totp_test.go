@@ -0,0 +1,61 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 seed of the RFC 6238 appendix B test vectors.
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestVerifyTOTPVectors(t *testing.T) {
+	// RFC 6238 appendix B, SHA1, the last 6 of the 8 published digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			step, ok := VerifyTOTP(rfc6238Secret, tt.code, time.Unix(tt.unix, 0))
+			if !ok {
+				t.Fatalf("code %s rejected at %d", tt.code, tt.unix)
+			}
+			if step != tt.unix/totpStep {
+				t.Fatalf("expected step %d, got %d", tt.unix/totpStep, step)
+			}
+		})
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	at := time.Unix(1111111111, 0)
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		at     time.Time
+		ok     bool
+	}{
+		{"previous step", rfc6238Secret, "050471", at.Add(totpStep * time.Second), true},
+		{"next step", rfc6238Secret, "050471", at.Add(-totpStep * time.Second), true},
+		{"outside of skew", rfc6238Secret, "050471", at.Add(2 * totpStep * time.Second), false},
+		{"lower case secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "050471", at, true},
+		{"wrong code", rfc6238Secret, "050472", at, false},
+		{"8 digits", rfc6238Secret, "14050471", at, false},
+		{"invalid secret", "not base32!", "050471", at, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := VerifyTOTP(tt.secret, tt.code, tt.at); ok != tt.ok {
+				t.Fatalf("expected %v, got %v", tt.ok, ok)
+			}
+		})
+	}
+}
@@ -1,13 +1,53 @@
 package server
 
 import (
+	"encoding/json"
 	"github.com/go-chi/render"
+	"time"
 )
 
 const (
-	MinioBucketName = "astral"
+	MinioBucketName           = "astral"
+	MinioThumbnailsBucketName = "astral-thumbnails"
+
+	tokenTouchInterval = time.Minute
+	// many users may share an address, so it gets more attempts than a single login
+	ipAttemptsFactor = 5
+
+	// grant entries starting with it refer to groups instead of users
+	groupGrantPrefix = "@"
+
+	passwordResetTTL        = 24 * time.Hour
+	maxLoginLength          = 255
+	loginRequirementsMsg    = "Login must be 1-255 characters without ':' and ',' and can't start with '@'"
+	passwordRequirementsMsg = "Password must contain: minimum length 8, digits, at least 2 letters in different cases, at least 1 character (not a letter or a number)"
 )
 
+type Config struct {
+	Host      string
+	Port      string
+	RootToken string
+
+	// LegacyToken allows ?token= and meta.token in addition to the Authorization header
+	LegacyToken bool
+
+	PasswordParams PasswordParams
+
+	TokenTTL           time.Duration
+	TokenIdleTimeout   time.Duration
+	RefreshTTL         time.Duration
+	TokenPurgeInterval time.Duration
+	GrantSweepInterval time.Duration
+
+	PendingRescanInterval time.Duration
+
+	LoginMaxAttempts int
+	LoginLockout     time.Duration
+
+	ThumbnailWorkers int
+	ExtractWorkers   int
+}
+
 type ResponseError struct {
 	Code int    `json:"code"`
 	Text string `json:"text"`
@@ -23,29 +63,299 @@ type RegisterRequest struct {
 	Token    string `json:"token,omitempty"`
 	Login    string `json:"login"`
 	Password string `json:"pswd"`
+	Device   string `json:"device,omitempty"`
+	Role     string `json:"role,omitempty"`
+
+	// second factor, checked when the user has 2FA enabled
+	OTP          string `json:"otp,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+type APIKeyRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	DocPrefix string   `json:"doc_prefix,omitempty"`
+}
+
+type APIKeyResponse struct {
+	Id         int64    `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	DocPrefix  string   `json:"doc_prefix"`
+	CreatedAt  string   `json:"created_at"`
+	LastUsedAt string   `json:"last_used_at"`
+}
+
+func NewAPIKeyResponse(key APIKey) APIKeyResponse {
+	scopes := []string(key.Scopes)
+	if scopes == nil {
+		scopes = make([]string, 0)
+	}
+	return APIKeyResponse{
+		Id:         key.Id,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     scopes,
+		DocPrefix:  key.DocPrefix,
+		CreatedAt:  key.CreatedAt.Format(time.RFC3339),
+		LastUsedAt: key.LastUsedAt.Format(time.RFC3339),
+	}
+}
+
+type UserResponse struct {
+	Id             int64  `json:"id"`
+	Login          string `json:"login"`
+	Role           string `json:"role"`
+	Disabled       bool   `json:"disabled"`
+	ServiceAccount bool   `json:"service_account"`
+	TotpEnabled    bool   `json:"totp_enabled"`
+	TotpRequired   bool   `json:"totp_required"`
+}
+
+func NewUserResponse(user User) UserResponse {
+	return UserResponse{
+		Id:             user.Id,
+		Login:          user.Login,
+		Role:           user.Role,
+		Disabled:       user.Disabled,
+		ServiceAccount: user.ServiceAccount,
+		TotpEnabled:    user.TotpEnabled,
+		TotpRequired:   user.TotpRequired,
+	}
+}
+
+type ShareLinkRequest struct {
+	Password     string  `json:"password,omitempty"`
+	ExpiresAt    *string `json:"expires_at,omitempty"`
+	MaxDownloads *int64  `json:"max_downloads,omitempty"`
+}
+
+type ShareLinkResponse struct {
+	Id           int64   `json:"id"`
+	Url          string  `json:"url"`
+	HasPassword  bool    `json:"has_password"`
+	ExpiresAt    *string `json:"expires_at"`
+	MaxDownloads *int64  `json:"max_downloads"`
+	Downloads    int64   `json:"downloads"`
+	Created      string  `json:"created"`
+}
+
+func NewShareLinkResponse(link ShareLink) ShareLinkResponse {
+	var expiresAt *string
+	if link.ExpiresAt != nil {
+		s := link.ExpiresAt.Format(time.RFC3339)
+		expiresAt = &s
+	}
+	return ShareLinkResponse{
+		Id:           link.Id,
+		Url:          shareLinkPath + link.Slug,
+		HasPassword:  link.PasswordHash != "",
+		ExpiresAt:    expiresAt,
+		MaxDownloads: link.MaxDownloads,
+		Downloads:    link.Downloads,
+		Created:      link.Created.Format(time.RFC3339),
+	}
+}
+
+type ShareAccessResponse struct {
+	At        string `json:"at"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Result    string `json:"result"`
+}
+
+type GroupRequest struct {
+	Name string `json:"name"`
+}
+
+type GroupMembersRequest struct {
+	Logins []string `json:"logins"`
+}
+
+type GroupResponse struct {
+	Id      int64    `json:"id"`
+	Name    string   `json:"name"`
+	Owner   string   `json:"owner"`
+	Created string   `json:"created"`
+	Members []string `json:"members"`
+}
+
+func NewGroupResponse(group Group) GroupResponse {
+	members := group.Members
+	if members == nil {
+		members = make([]string, 0)
+	}
+	return GroupResponse{
+		Id:      group.Id,
+		Name:    group.Name,
+		Owner:   group.OwnerLogin,
+		Created: group.Created.Format("2006-01-02 15:04:05"),
+		Members: members,
+	}
+}
+
+type NotificationResponse struct {
+	Id      int64  `json:"id"`
+	Message string `json:"message"`
+	Created string `json:"created"`
+}
+
+func NewNotificationResponse(n Notification) NotificationResponse {
+	return NotificationResponse{
+		Id:      n.Id,
+		Message: n.Message,
+		Created: n.Created.Format("2006-01-02 15:04:05"),
+	}
+}
+
+type RoleRequest struct {
+	Role string `json:"role"`
+}
+
+// IdpLinkRequest binds a user to a JWT subject "iss|sub".
+type IdpLinkRequest struct {
+	Subject string `json:"subject"`
+}
+
+type ServiceAccountRequest struct {
+	Login string `json:"login"`
+}
+
+type TOTPRequest struct {
+	OTP          string `json:"otp,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+type TOTPEnrollRequest struct {
+	Password string `json:"pswd"`
+}
+
+type TOTPRequiredRequest struct {
+	Required bool `json:"required"`
+}
+
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_pswd"`
+	Password    string `json:"pswd"`
+}
+
+type ResetPasswordRequest struct {
+	ResetToken string `json:"reset_token"`
+	Password   string `json:"pswd"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
 }
 
 type DocPostRequest struct {
 	Meta struct {
-		Name   string   `json:"name"`
-		File   bool     `json:"file"`
-		Public bool     `json:"public"`
-		Token  string   `json:"token"`
-		Mime   string   `json:"mime"`
-		Grant  []string `json:"grant"`
+		Name   string      `json:"name"`
+		File   bool        `json:"file"`
+		Public bool        `json:"public"`
+		Token  string      `json:"token"`
+		Mime   string      `json:"mime"`
+		Grant  []GrantSpec `json:"grant"`
 	} `json:"meta"`
-	Json interface{} `json:"json,omitempty"`
+	Json json.RawMessage `json:"json,omitempty"`
 	File struct {
 		Data string `json:"data"`
 	} `json:"file"`
 }
 
 type DocResponse struct {
-	Id      int64    `json:"id"`
-	Name    string   `json:"name"`
-	Mime    string   `json:"mime"`
-	File    bool     `json:"file"`
-	Public  bool     `json:"public"`
-	Created string   `json:"created"`
-	Grant   []string `json:"grant"`
+	Id       int64           `json:"id"`
+	Name     string          `json:"name"`
+	Mime     string          `json:"mime"`
+	File     bool            `json:"file"`
+	Public   bool            `json:"public"`
+	Created  string          `json:"created"`
+	Modified string          `json:"modified"`
+	Size     int64           `json:"size"`
+	Hash     string          `json:"hash"`
+	Grant    []string        `json:"grant"`
+	Grants   []GrantResponse `json:"grants"`
+}
+
+type GrantResponse struct {
+	Login       string   `json:"login"`
+	Permissions []string `json:"permissions"`
+	ExpiresAt   *string  `json:"expires_at,omitempty"`
+}
+
+func NewGrantResponses(grants []DocGrant) []GrantResponse {
+	resp := make([]GrantResponse, 0, len(grants))
+	for _, g := range grants {
+		grant := GrantResponse{Login: g.Name, Permissions: g.Permissions.Names()}
+		if g.ExpiresAt != nil {
+			expiresAt := g.ExpiresAt.Format(time.RFC3339)
+			grant.ExpiresAt = &expiresAt
+		}
+		resp = append(resp, grant)
+	}
+	return resp
+}
+
+type DocGrantsPatchRequest struct {
+	Public *bool       `json:"public,omitempty"`
+	Add    []GrantSpec `json:"add"`
+	Remove []string    `json:"remove"`
+}
+
+type DocGrantsPutRequest struct {
+	Public *bool       `json:"public,omitempty"`
+	Grants []GrantSpec `json:"grants"`
+}
+
+func NewDocResponse(doc Doc) DocResponse {
+	grant := doc.Grant
+	if grant == nil {
+		grant = make([]string, 0)
+	}
+	return DocResponse{
+		Id:       doc.Id,
+		Name:     doc.Filename,
+		Mime:     doc.Mime,
+		File:     true,
+		Public:   doc.Public,
+		Created:  doc.Created.Format("2006-01-02 15:04:05"),
+		Modified: doc.Modified.Format("2006-01-02 15:04:05"),
+		Size:     doc.Size,
+		Hash:     doc.Hash,
+		Grant:    grant,
+		Grants:   NewGrantResponses(doc.Grants),
+	}
+}
+
+type DocsZipRequest struct {
+	Ids   []int64 `json:"ids"`
+	Key   string  `json:"key"`
+	Value string  `json:"value"`
+}
+
+type SessionResponse struct {
+	Id         int64  `json:"id"`
+	Device     string `json:"device"`
+	UserAgent  string `json:"user_agent"`
+	IP         string `json:"ip"`
+	IssuedAt   string `json:"issued_at"`
+	ExpiresAt  string `json:"expires_at"`
+	LastUsedAt string `json:"last_used_at"`
+	Current    bool   `json:"current"`
+}
+
+// DocPatchRequest changes metadata of a doc, absent fields stay as they are.
+// Json set to null removes the attached json.
+type DocPatchRequest struct {
+	Name *string         `json:"name,omitempty"`
+	Mime *string         `json:"mime,omitempty"`
+	Json json.RawMessage `json:"json,omitempty"`
+}
+
+type DocPutRequest struct {
+	Mime string `json:"mime,omitempty"`
+	File struct {
+		Data string `json:"data"`
+	} `json:"file"`
 }
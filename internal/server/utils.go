@@ -3,19 +3,120 @@ package server
 import (
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
-	"math/rand"
-	"time"
+	"golang.org/x/crypto/argon2"
+	"strings"
 	"unicode"
 	"unicode/utf8"
 )
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
+type PasswordParams struct {
+	Memory     uint32
+	Time       uint32
+	Threads    uint8
+	SaltLength uint32
+	KeyLength  uint32
 }
 
-func GeneratePasswordHash(password string) (string, error) {
+var DefaultPasswordParams = PasswordParams{
+	Memory:     64 * 1024,
+	Time:       1,
+	Threads:    4,
+	SaltLength: 16,
+	KeyLength:  32,
+}
+
+const (
+	argon2idPrefix = "$argon2id$"
+
+	// stored hashes are trusted only within these bounds: zero time or threads panic in argon2,
+	// huge memory or time turns a login into a DoS and an empty key matches any password
+	argon2MaxMemory    = 1 << 20
+	argon2MaxTime      = 16
+	argon2MinKeyLength = 16
+)
+
+func (p PasswordParams) Validate() error {
+	if p.Time < 1 || p.Time > argon2MaxTime || p.Threads < 1 || p.Memory > argon2MaxMemory ||
+		p.SaltLength < argon2MinKeyLength || p.KeyLength < argon2MinKeyLength {
+		return fmt.Errorf("Argon2 params are out of bounds: time 1-%d, threads from 1, memory up to %d KiB ", argon2MaxTime, argon2MaxMemory)
+	}
+	return nil
+}
+
+// GeneratePasswordHash hashes the password with argon2id into a self-describing string:
+// $argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>
+func GeneratePasswordHash(password string, params PasswordParams) (string, error) {
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("Failed to generate password salt. Error: %s ", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		params.Memory,
+		params.Time,
+		params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// VerifyPassword checks the password against the stored hash in constant time.
+// rehash is true when the hash is valid but was made by the legacy scheme or with other params.
+func VerifyPassword(password string, encoded string, params PasswordParams) (ok bool, rehash bool, err error) {
+	if !strings.HasPrefix(encoded, argon2idPrefix) {
+		legacy, err := legacyPasswordHash(password)
+		if err != nil {
+			return false, false, err
+		}
+		ok = subtle.ConstantTimeCompare([]byte(legacy), []byte(encoded)) == 1
+		return ok, ok, nil
+	}
+
+	var version int
+	var stored PasswordParams
+	var saltB64, keyB64 string
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return false, false, fmt.Errorf("Invalid password hash format ")
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false, fmt.Errorf("Unsupported argon2 version ")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &stored.Memory, &stored.Time, &stored.Threads); err != nil {
+		return false, false, fmt.Errorf("Invalid argon2 params. Error: %s ", err)
+	}
+	saltB64, keyB64 = parts[4], parts[5]
+
+	salt, err := base64.RawStdEncoding.DecodeString(saltB64)
+	if err != nil {
+		return false, false, fmt.Errorf("Invalid password salt. Error: %s ", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(keyB64)
+	if err != nil {
+		return false, false, fmt.Errorf("Invalid password hash. Error: %s ", err)
+	}
+	stored.SaltLength = uint32(len(salt))
+	stored.KeyLength = uint32(len(key))
+	if err := stored.Validate(); err != nil {
+		return false, false, err
+	}
+
+	actual := argon2.IDKey([]byte(password), salt, stored.Time, stored.Memory, stored.Threads, stored.KeyLength)
+	ok = subtle.ConstantTimeCompare(actual, key) == 1
+	return ok, ok && stored != params, nil
+}
+
+// legacyPasswordHash is the old HMAC-MD5 scheme, kept only to verify and upgrade existing hashes.
+func legacyPasswordHash(password string) (string, error) {
 	secretKey := []byte("homo sapiens")
 	mac := hmac.New(md5.New, secretKey)
 	if _, err := mac.Write([]byte(password)); err != nil {
@@ -25,13 +126,31 @@ func GeneratePasswordHash(password string) (string, error) {
 }
 
 func GenerateSecureToken() (string, error) {
-	b := make([]byte, 30)
+	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
-		return "", nil
+		return "", fmt.Errorf("Failed to read random bytes. Error: %s ", err)
 	}
 	return hex.EncodeToString(b), nil
 }
 
+// HashToken is what gets stored instead of the token itself, so a db leak doesn't expose live sessions.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func ContentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// IsLoginValid keeps logins apart from the grant syntax: "login:read,write" is split on ':'
+// and "@name" is a group, so such logins could never be granted unambiguously.
+func IsLoginValid(login string) bool {
+	return login != "" && len(login) <= maxLoginLength && !strings.ContainsAny(login, ":,") &&
+		!strings.HasPrefix(login, groupGrantPrefix)
+}
+
 func IsPasswordValid(s string) bool {
 	var (
 		hasMinLen  = false
@@ -57,3 +176,14 @@ func IsPasswordValid(s string) bool {
 	}
 	return hasMinLen && hasUpper && hasLower && hasNumber && hasSpecial
 }
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[:n]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+// testPasswordParams keep argon2 cheap, the scheme is the same as with the defaults.
+var testPasswordParams = PasswordParams{Memory: 1024, Time: 1, Threads: 1, SaltLength: 16, KeyLength: 32}
+
+func TestVerifyPassword(t *testing.T) {
+	const password = "Secret-123"
+	encoded, err := GeneratePasswordHash(password, testPasswordParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatalf("unexpected hash format %s", encoded)
+	}
+	legacy, err := legacyPasswordHash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stronger := testPasswordParams
+	stronger.Time = 2
+	longerKey := testPasswordParams
+	longerKey.KeyLength = 64
+
+	tests := []struct {
+		name     string
+		password string
+		encoded  string
+		params   PasswordParams
+		ok       bool
+		rehash   bool
+	}{
+		{"argon2id", password, encoded, testPasswordParams, true, false},
+		{"argon2id wrong password", "Secret-124", encoded, testPasswordParams, false, false},
+		{"argon2id with changed time", password, encoded, stronger, true, true},
+		{"argon2id with changed key length", password, encoded, longerKey, true, true},
+		{"legacy is upgraded", password, legacy, testPasswordParams, true, true},
+		{"legacy wrong password", "Secret-124", legacy, testPasswordParams, false, false},
+		{"empty hash", password, "", testPasswordParams, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash, err := VerifyPassword(tt.password, tt.encoded, tt.params)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if ok != tt.ok || rehash != tt.rehash {
+				t.Fatalf("expected ok=%v rehash=%v, got ok=%v rehash=%v", tt.ok, tt.rehash, ok, rehash)
+			}
+		})
+	}
+}
+
+func TestVerifyPasswordParams(t *testing.T) {
+	// params are read from the hash, so hashes made with older settings keep working
+	for _, params := range []PasswordParams{
+		{Memory: 2048, Time: 2, Threads: 2, SaltLength: 16, KeyLength: 16},
+		{Memory: 1024, Time: 3, Threads: 4, SaltLength: 32, KeyLength: 64},
+	} {
+		encoded, err := GeneratePasswordHash("Secret-123", params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, rehash, err := VerifyPassword("Secret-123", encoded, testPasswordParams)
+		if err != nil || !ok || !rehash {
+			t.Fatalf("%s: expected ok and rehash, got ok=%v rehash=%v err=%v", encoded, ok, rehash, err)
+		}
+	}
+}
+
+func TestVerifyPasswordMalformed(t *testing.T) {
+	encoded, err := GeneratePasswordHash("Secret-123", testPasswordParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(encoded, "$")
+	with := func(i int, value string) string {
+		p := append([]string(nil), parts...)
+		p[i] = value
+		return strings.Join(p, "$")
+	}
+
+	tests := map[string]string{
+		"missing key":    strings.Join(parts[:5], "$"),
+		"extra part":     encoded + "$x",
+		"old version":    with(2, "v=16"),
+		"no version":     with(2, "19"),
+		"bad params":     with(3, "m=1024,t=x,p=1"),
+		"missing params": with(3, "m=1024"),
+		"bad salt":       with(4, "not base64!"),
+		"bad key":        with(5, "not base64!"),
+		"zero time":      with(3, "m=1024,t=0,p=1"),
+		"zero threads":   with(3, "m=1024,t=1,p=0"),
+		"huge memory":    with(3, "m=4294967295,t=1,p=1"),
+		"huge time":      with(3, "m=1024,t=4294967295,p=1"),
+		"empty key":      with(5, ""),
+		"short key":      with(5, "AAAAAAAAAAAAAAAAAAAA"),
+		"empty salt":     with(4, ""),
+		"short salt":     with(4, "AAAA"),
+	}
+	for name, encoded := range tests {
+		t.Run(name, func(t *testing.T) {
+			ok, _, err := VerifyPassword("Secret-123", encoded, testPasswordParams)
+			if err == nil || ok {
+				t.Fatalf("expected error for %s, got ok=%v", encoded, ok)
+			}
+		})
+	}
+}